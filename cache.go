@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+var (
+	cacheMu    sync.Mutex
+	checkCache = map[string]*cachedResult{} // By cacheKey, see cachedRun
+)
+
+// Result of a check shared by identical checks on other interfaces
+type cachedResult struct {
+	done    chan struct{} // Closed once success and latency are set
+	time    time.Time
+	success bool
+	latency time.Duration
+}
+
+// Runs the check, or reuses the result of an identical one run
+// within cacheTTL, reported as cached. Identical checks running at
+// once wait on the first rather than probing together. Checks bound
+// to an interface probe their own path and always run. Only probes
+// that ran are traced, a cached result gets no span
+func (c *vpsHealthCheck) cachedRun(ctx context.Context) (success, known, cached bool) {
+	if config.cacheTTL == 0 || c.BindToInterface || !checkTypes[c.Type] {
+		success, known = c.tracedRun(ctx)
+		return success, known, false
+	}
+	key := c.cacheKey()
+
+	cacheMu.Lock()
+	r, found := checkCache[key]
+	if found {
+		select {
+		case <-r.done:
+			found = time.Since(r.time) < config.cacheTTL
+		default:
+		}
+	}
+	if !found {
+		r = &cachedResult{done: make(chan struct{})}
+		checkCache[key] = r
+	}
+	cacheMu.Unlock()
+
+	if found {
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			return false, true, true
+		}
+		log.WithField("check", c.Name).Trace("Using cached check result")
+		c.latency = r.latency
+		return r.success, true, true
+	}
+
+	success, known = c.tracedRun(ctx)
+	r.time, r.success, r.latency = time.Now(), success, c.latency
+	close(r.done)
+
+	// Results cut short by a deadline aren't worth sharing
+	if ctx.Err() != nil {
+		cacheMu.Lock()
+		if checkCache[key] == r {
+			delete(checkCache, key)
+		}
+		cacheMu.Unlock()
+	}
+	return success, known, false
+}
+
+// Identifies checks that probe the same target the same way,
+// everything configured but the name, quorum and failure settings
+func (c *vpsHealthCheck) cacheKey() string {
+	k := *c
+	k.Name, k.Weight, k.Enabled, k.FailuresToUnhealthy = "", 0, nil, 0
+	b, _ := json.Marshal(k)
+	return string(b)
+}
+
+// Forgets every cached result. Called at the start of each tick
+// when cacheTTL is shorter than it, so every tick probes shared
+// targets at least once, and on config loads
+func clearCache() {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	checkCache = map[string]*cachedResult{}
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -10,72 +17,259 @@ import (
 )
 
 const (
-	defInterval       = "1m"    // Default time between checks
-	defTimeout        = "1s"    // Default timeout for health checks
-	defRetryInterval  = "250ms" // Default wait between retries
-	defICMPInterval   = "1s"    // Default ICMP Request Interval
-	defWGMaxHandshake = "2m30s" // Max time since last Wireguard Peer handshake
-	defMinTimeOut     = "30s"   // Minimum amount of time between checks of unhealthy interface (penalty box)
+	defInterval        = "1m"             // Default time between checks
+	defTimeout         = "1s"             // Default timeout for health checks
+	defRetryInterval   = "250ms"          // Default wait between retries
+	defRetryBackoffMax = "10s"            // Default cap on exponential retry waits
+	defReflectTimeout  = "5s"             // Default time for wgReflector to test the listen port
+	defICMPInterval    = "1s"             // Default ICMP Request Interval
+	defWGMaxHandshake  = "2m30s"          // Max time since last Wireguard Peer handshake
+	defMinTimeOut      = "30s"            // Minimum amount of time between checks of unhealthy interface (penalty box)
+	defNotifyTimeout   = "5s"             // Timeout delivering notifications
+	defNotifyRateLimit = "1m"             // Minimum time between chat notifications
+	defHookTimeout     = "10s"            // Default limit on transition hooks
+	defMaxBodyBytes    = 64 * 1024        // Most of an HTTP response body read for matchRegEx
+	minPacketSize      = 24               // Smallest ICMP payload, go-ping's timestamp and tracker
+	maxPacketSize      = 65507            // Largest ICMP payload in an IPv4 packet
+	reusedIdleTimeout  = 90 * time.Second // Idle lifetime of connections kept by reuseConnections
 )
 
+// Health check types implemented by healthCheck
+var checkTypes = map[string]bool{
+	"tcp":   true,
+	"icmp":  true,
+	"http":  true,
+	"http3": true,
+	"grpc":  true,
+	"tls":   true,
+	"exec":  true,
+	"udp":   true,
+}
+
+// Matches ${VAR} references in the config, bare $ is left
+// alone so regexes like `up$` survive expansion
+var envVarRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
 var (
 	configFile string = "config.yaml"
 	config     *vpsInstance
 	logLevel   string = "info"
-	log        *logrus.Logger
+	logFormat  string
+	log        = logrus.New() // Set up in place by each load, never replaced
 	interval   time.Duration
+	tick       time.Duration // Shortest interface interval, the main loop's period
+	dryRun     bool
 )
 
+// Loads the config, exiting if it can't be used
 func loadConfig() {
+	if errs := tryLoadConfig(); len(errs) > 0 {
+		var ss []string
+		for _, e := range errs {
+			ss = append(ss, e.Error())
+		}
+		log.Fatalf("Invalid configuration %s: %s", configFile, strings.Join(ss, "; "))
+	}
+}
+
+// Loads and validates the config, returning why it can't be used.
+// The config is built aside and only swapped into the globals once
+// valid, see saveConfig to undo a load that NFTables then refuses
+func tryLoadConfig() []error {
 
-	// Logging
+	// Logging, the logger is set up in place since
+	// goroutines outside a check run may be logging
 	level, err := logrus.ParseLevel(logLevel)
 	if err != nil {
 		level = logrus.InfoLevel
 	}
-	log = logrus.New()
 	log.SetLevel(level)
 
-	// Config
-	log.Debugf("Reading configuration from %s", configFile)
-	yamlConf, err := ioutil.ReadFile(configFile)
+	// Config, merged in order when given several files
+	files, err := configFiles()
 	if err != nil {
-		log.Fatalf("Failed to read config file %s: %+v", configFile, err)
+		return []error{fmt.Errorf("failed to find config %s: %v", configFile, err)}
 	}
+	conf := new(vpsInstance)
+	for _, file := range files {
+		log.Debugf("Reading configuration from %s", file)
+		yamlConf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return []error{fmt.Errorf("failed to read config file %s: %v", file, err)}
+		}
 
-	// Unmarshal yaml
-	config = new(vpsInstance)
-	err = yaml.Unmarshal(yamlConf, config)
-	if err != nil {
-		log.Fatalf("Failed to unmashal yaml config: %+v", err)
+		// Expand ${VAR} from the environment
+		yamlConf = expandEnv(yamlConf)
+
+		// Unmarshal yaml or json
+		fileConf := new(vpsInstance)
+		err = unmarshalConfig(file, yamlConf, fileConf)
+		if err != nil {
+			return []error{fmt.Errorf("failed to unmashal config %s: %v", file, err)}
+		}
+		if err := mergeConfig(conf, fileConf); err != nil {
+			return []error{fmt.Errorf("failed to merge config %s: %v", file, err)}
+		}
+	}
+
+	// Drop disabled interfaces and checks, as if not configured
+	var enabled []*vpsInterface
+	for _, i := range conf.Interfaces {
+		if i.Enabled != nil && !*i.Enabled {
+			log.WithField("nif", i.Name).Debug("Skipping disabled interface")
+			conf.disabled = append(conf.disabled, i.Name)
+			continue
+		}
+		var checks []*vpsHealthCheck
+		for _, c := range i.Checks {
+			if c.Enabled != nil && !*c.Enabled {
+				log.WithFields(logrus.Fields{
+					"nif":   i.Name,
+					"check": c.Name,
+				}).Debug("Skipping disabled check")
+				continue
+			}
+			checks = append(checks, c)
+		}
+		i.Checks = checks
+		enabled = append(enabled, i)
 	}
+	conf.Interfaces = enabled
+
+	// Dry run if asked by flag or config
+	conf.DryRun = conf.DryRun || dryRun
 
 	// Set Interval
-	interval = getDuration("config.Interval", config.Interval, defInterval)
+	newInterval := getDuration("config.Interval", conf.Interval, defInterval)
+
+	// Interfaces may set their own interval, the main
+	// loop ticks at the shortest and runs those due
+	newTick := newInterval
+	for _, i := range conf.Interfaces {
+		i.interval = getDuration("Interval "+i.Name, i.Interval, newInterval.String())
+		if i.interval > 0 && i.interval < newTick {
+			newTick = i.interval
+		}
+	}
 
 	// Set minimum time unhealthy interface is pulled from chain
-	config.minTimeOut = getDuration("Minimum Time Out", config.MinTimeOut, defMinTimeOut)
+	conf.minTimeOut = getDuration("Minimum Time Out", conf.MinTimeOut, defMinTimeOut)
 
-	// Prepare wireguard client if any wg interfaces
-	// are configured.
-	//
-	// Will force a check for last handshake if WGPeer given,
-	// max last handshake configurable via flag
-	for _, i := range config.Interfaces {
-		if i.Wireguard {
-			wgInit()
-			break
-		}
+	// Repeated failures back off up to maxTimeOut, flat by default
+	conf.maxTimeOut = conf.minTimeOut
+	if conf.MaxTimeOut != "" {
+		conf.maxTimeOut = getDuration("Maximum Time Out", conf.MaxTimeOut, defMinTimeOut)
+	}
+
+	// Each interface's checks must finish within a tick by default
+	conf.tickDeadline = newTick
+	if conf.TickDeadline != "" {
+		conf.tickDeadline = getDuration("Tick Deadline", conf.TickDeadline, newTick.String())
+	}
+
+	// Optional random delay before each interface's checks
+	conf.jitter = getDuration("Jitter", conf.Jitter, "0s")
+
+	// Identical checks share results for this long, off by default
+	conf.cacheTTL = getDuration("Cache TTL", conf.CacheTTL, "0s")
+
+	// Optional time after starting to watch before acting
+	conf.startupGrace = getDuration("Startup Grace", conf.StartupGrace, "0s")
+
+	// Notifications shouldn't linger
+	conf.notifyTimeout = getDuration("Notify Timeout", conf.NotifyTimeout, defNotifyTimeout)
+	conf.notifyRateLimit = getDuration("Notify Rate Limit", conf.NotifyRateLimit, defNotifyRateLimit)
+	conf.hookTimeout = getDuration("Hook Timeout", conf.HookTimeout, defHookTimeout)
+
+	// Check every interface at once unless limited
+	if conf.MaxConcurrency < 1 {
+		conf.MaxConcurrency = len(conf.Interfaces)
+	}
+
+	// Probes across interfaces queue for a slot when limited.
+	// Checks are waited on before a reload, none hold the old one
+	var newProbeSem chan struct{}
+	if conf.MaxConcurrentChecks > 0 {
+		newProbeSem = make(chan struct{}, conf.MaxConcurrentChecks)
+	}
+
+	// Flap hysteresis, default to acting on every check
+	if conf.HealthyThreshold < 1 {
+		conf.HealthyThreshold = 1
+	}
+	if conf.UnhealthyThreshold < 1 {
+		conf.UnhealthyThreshold = 1
 	}
 
 	// Handle Durations
-	for _, i := range config.Interfaces {
+	for _, i := range conf.Interfaces {
+		// A prefix only makes sense for a dynamic address
+		if i.IPv6Prefix != "" {
+			i.DynamicIPv6 = true
+			if _, prefix, err := net.ParseCIDR(i.IPv6Prefix); err == nil {
+				i.ipv6Prefix = prefix
+			}
+		}
+
+		// Validated below
+		if i.ExpectRoute != "" {
+			i.expectRoute, _ = parseExpectRoute(i.ExpectRoute)
+		}
+
+		// Interfaces hand traffic to their target chain by default
+		if i.Verdict == "" {
+			i.Verdict = "goto"
+		}
+
 		// Max time since last wireguard peer handshake
 		if i.Wireguard && i.WGPeer != "" {
 			i.wgMaxHandshake = getDuration("Wireguard Max Handshake "+i.Name, i.WGMaxHandshake, defWGMaxHandshake)
+			// Optional max time without received data
+			if i.WGMaxRxIdle != "" {
+				i.wgMaxRxIdle = getDuration("Wireguard Max Rx Idle "+i.Name, i.WGMaxRxIdle, "0s")
+			}
+			// Optional peer endpoint probe
+			if i.WGEndpointCheck != "" {
+				i.wgEndpointProbe = &vpsHealthCheck{
+					Name:        "wg_endpoint_reachable",
+					Type:        i.WGEndpointCheck,
+					Port:        i.WGEndpointPort,
+					tmout:       getDuration("Wireguard Endpoint Timeout "+i.Name, "", defTimeout),
+					reqInterval: getDuration("Wireguard Endpoint Interval "+i.Name, "", defRetryInterval),
+				}
+			}
+		}
+
+		// Optional inbound probe through a reflector,
+		// the URL is filled in with the listen port per run
+		if i.Wireguard && i.WGReflector != "" {
+			i.wgReflectorProbe = &vpsHealthCheck{
+				Name:          "wg_inbound_reachable",
+				Type:          "http",
+				Method:        "GET",
+				MaxBodyBytes:  defMaxBodyBytes,
+				responseCodes: []codeRange{{200, 299}},
+				tmout:         getDuration("Wireguard Reflector Timeout "+i.Name, i.WGReflectTimeout, defReflectTimeout),
+				reqInterval:   getDuration("Wireguard Reflector Interval "+i.Name, "", defRetryInterval),
+			}
+		}
+
+		// Optional gateway probe, a couple of quick pings
+		// sourced from the interface address
+		if i.Gateway != "" {
+			i.gatewayProbe = &vpsHealthCheck{
+				Name:        "gateway_reachable",
+				Type:        "icmp",
+				Host:        i.Gateway,
+				Count:       2,
+				tmout:       getDuration("Gateway Timeout "+i.Name, "", defTimeout),
+				reqInterval: getDuration("Gateway Interval "+i.Name, "", defRetryInterval),
+			}
 		}
 
 		for _, c := range i.Checks {
+			c.nif = i.Name
+
 			// Timeout
 			c.tmout = getDuration(fmt.Sprintf("Check timeout %s %s", i.Name, c.Name), c.Timeout, defTimeout)
 
@@ -87,8 +281,440 @@ func loadConfig() {
 				checkDefaultInterval = defRetryInterval
 			}
 			c.reqInterval = getDuration(fmt.Sprintf("Check timeout %s %s", i.Name, c.Name), c.Interval, checkDefaultInterval)
+
+			// Retries wait a fixed interval unless backing off
+			if c.RetryBackoff == "" {
+				c.RetryBackoff = "fixed"
+			}
+			c.retryBackoffMax = getDuration(fmt.Sprintf("Check retry backoff max %s %s", i.Name, c.Name), c.RetryBackoffMax, defRetryBackoffMax)
+
+			// ICMP RTT, the duration wins over milliseconds
+			c.maxRTT = time.Duration(c.MaxRTT) * time.Millisecond
+			if c.MaxRTTDuration != "" {
+				c.maxRTT = getDuration(fmt.Sprintf("Check max RTT %s %s", i.Name, c.Name), c.MaxRTTDuration, "0s")
+			}
+
+			// Resolvers listen on 53 unless told otherwise
+			if c.Resolver != "" {
+				if _, _, err := net.SplitHostPort(c.Resolver); err != nil {
+					c.Resolver = net.JoinHostPort(c.Resolver, "53")
+				}
+			}
+
+			// HTTP bodies are read up to a limit
+			if c.MaxBodyBytes == 0 {
+				c.MaxBodyBytes = defMaxBodyBytes
+			}
+
+			// One transport per check load, replaced on reload
+			if c.ReuseConnections {
+				c.conns = &reusedConns{}
+			}
+
+			// Failures count right away unless set
+			if c.FailuresToUnhealthy == 0 {
+				c.FailuresToUnhealthy = 1
+			}
+
+			// Quorum weight, equal unless set
+			if c.Weight == 0 {
+				c.Weight = 1
+			}
+
+			// Expected HTTP codes, validated below
+			c.responseCodes, _ = parseResponseCodes(c.ResponseCode, c.ResponseCodes)
+
+			// Patterns compiled once per load, validated below
+			c.matchRe, _ = compileRegEx(c.MatchRegEx)
+			c.expectRe, _ = compileRegEx(c.ExpectRegEx)
+		}
+	}
+
+	// A config from before loadBalancers describes a single one
+	if len(conf.LoadBalancers) == 0 {
+		conf.legacyLB = true
+		conf.LoadBalancers = []*loadBalancer{{
+			Table:         conf.LBTable,
+			Chain:         conf.LBChain,
+			ChainType:     conf.LBChainType,
+			ChainHook:     conf.LBChainHook,
+			ChainPriority: conf.LBChainPriority,
+		}}
+	}
+	if len(conf.HashKey) == 0 {
+		conf.HashKey = defHashKey
+	}
+	if conf.LBMode == "" {
+		conf.LBMode = "goto"
+	}
+	for _, lb := range conf.LoadBalancers {
+		if lb.Name == "" {
+			lb.Name = lb.Chain
+		}
+		if len(lb.HashKey) == 0 {
+			lb.HashKey = conf.HashKey
+		}
+		if lb.Mode == "" {
+			lb.Mode = conf.LBMode
+		}
+		// Balance across every interface unless listed, unknown
+		// names are validated below
+		lb.nifs = nil
+		for _, i := range conf.Interfaces {
+			if len(lb.Interfaces) == 0 || contains(lb.Interfaces, i.Name) {
+				lb.nifs = append(lb.nifs, i)
+			}
+		}
+	}
+
+	// Refuse to start with a broken config
+	if errs := validateConfig(conf, newInterval, newTick); len(errs) > 0 {
+		return errs
+	}
+
+	// Checks are waited on before a load, and goroutines
+	// outliving them copy what they need from config first
+	config, interval, tick, probeSem = conf, newInterval, newTick, newProbeSem
+
+	// Log format, flag wins over config
+	format := config.LogFormat
+	if logFormat != "" {
+		format = logFormat
+	}
+	switch format {
+	case "", "text":
+		log.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		log.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		log.SetFormatter(&logrus.TextFormatter{})
+		log.WithField("logFormat", format).Warn("Unknown log format, using text")
+	}
+
+	// Log file, reopened on every load so SIGHUP
+	// also works after logrotate moves the file
+	openLogFile()
+
+	// Telemetry follows otelEndpoint
+	initOTel()
+
+	// Prepare wireguard client if any wg interfaces
+	// are configured.
+	//
+	// Will force a check for last handshake if WGPeer given,
+	// max last handshake configurable via flag
+	for _, i := range config.Interfaces {
+		if i.Wireguard {
+			wgInit()
+			break
+		}
+	}
+
+	publishHistory(config.Interfaces)
+	clearCache()
+	return nil
+}
+
+// Globals and logger settings replaced by a config load
+type savedConfig struct {
+	config    *vpsInstance
+	level     logrus.Level
+	formatter logrus.Formatter
+	interval  time.Duration
+	tick      time.Duration
+	probeSem  chan struct{}
+}
+
+// Captures the running config so a rejected load can be undone
+func saveConfig() savedConfig {
+	return savedConfig{config, log.GetLevel(), log.Formatter, interval, tick, probeSem}
+}
+
+// Puts back the running config, its logger settings, log file,
+// telemetry and the interfaces the status server reports
+func (s savedConfig) restore() {
+	config, interval, tick, probeSem = s.config, s.interval, s.tick, s.probeSem
+	log.SetLevel(s.level)
+	log.SetFormatter(s.formatter)
+	openLogFile()
+	initOTel()
+	publishHistory(config.Interfaces)
+}
+
+// Replaces ${VAR} in the raw config with its environment
+// value, any field may reference the environment this way
+func expandEnv(conf []byte) []byte {
+	if !bytes.Contains(conf, []byte("${")) {
+		return conf
+	}
+	return envVarRe.ReplaceAllFunc(conf, func(m []byte) []byte {
+		name := envVarRe.FindSubmatch(m)[1]
+		v, ok := os.LookupEnv(string(name))
+		if !ok {
+			log.Warnf("Config references unset environment variable %s", name)
+		}
+		return []byte(v)
+	})
+}
+
+// Checks the loaded config for mistakes that would
+// otherwise only surface deep in the check loop
+func validateConfig(conf *vpsInstance, interval, tick time.Duration) []error {
+	var errs []error
+	if len(conf.Interfaces) == 0 {
+		errs = append(errs, errors.New("no interfaces configured"))
+	}
+	if conf.LogMaxSize < 0 || conf.LogMaxBackups < 0 || conf.LogMaxAge < 0 {
+		errs = append(errs, errors.New("logMaxSize, logMaxBackups and logMaxAge must not be negative"))
+	}
+	if conf.OTelEndpoint != "" && !strings.HasPrefix(conf.OTelEndpoint, "http://") && !strings.HasPrefix(conf.OTelEndpoint, "https://") {
+		errs = append(errs, fmt.Errorf("otelEndpoint %s must be an http or https URL", conf.OTelEndpoint))
+	}
+	if conf.MaxConcurrentChecks < 0 {
+		errs = append(errs, fmt.Errorf("maxConcurrentChecks %d is negative", conf.MaxConcurrentChecks))
+	}
+	if conf.cacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("cacheTTL %s is negative", conf.cacheTTL))
+	}
+	if conf.HistoryDepth < 0 {
+		errs = append(errs, fmt.Errorf("historyDepth %d is negative", conf.HistoryDepth))
+	}
+	if interval <= 0 {
+		errs = append(errs, fmt.Errorf("interval %s must be positive", interval))
+	}
+	if conf.jitter < 0 || conf.jitter >= tick {
+		errs = append(errs, fmt.Errorf("jitter %s must be at least 0 and less than the shortest interval %s", conf.jitter, tick))
+	}
+	if !conf.legacyLB && (conf.LBTable.Name != "" || conf.LBChain != "") {
+		errs = append(errs, errors.New("lbTable and lbChain can't be combined with loadBalancers"))
+	}
+	lbNames := make(map[string]bool)
+	needsTarget := make(map[string]bool) // Interfaces some goto load balancer routes to
+	for _, lb := range conf.LoadBalancers {
+		if lb.Table.Name == "" || lb.Chain == "" {
+			errs = append(errs, fmt.Errorf("load balancer %s needs a table name and chain", lb.Name))
+		}
+		if lbNames[lb.Name] {
+			errs = append(errs, fmt.Errorf("load balancer %s defined more than once", lb.Name))
+		}
+		lbNames[lb.Name] = true
+		if _, err := tableFamily(lb.Table.Family); err != nil {
+			errs = append(errs, fmt.Errorf("load balancer %s %v", lb.Name, err))
+		}
+		if _, _, _, err := chainBase(lb.ChainType, lb.ChainHook, lb.ChainPriority); err != nil {
+			errs = append(errs, fmt.Errorf("load balancer %s %v", lb.Name, err))
+		}
+		seen := make(map[string]bool)
+		for _, k := range lb.HashKey {
+			if _, found := hashFields[k]; !found {
+				errs = append(errs, fmt.Errorf("load balancer %s unknown hashKey field %s, want saddr, daddr, etherSaddr, l4proto, sport or dport", lb.Name, k))
+			} else if seen[k] {
+				errs = append(errs, fmt.Errorf("load balancer %s hashKey field %s listed more than once", lb.Name, k))
+			}
+			seen[k] = true
+		}
+		switch lb.Mode {
+		case "goto":
+			for _, i := range lb.nifs {
+				needsTarget[i.Name] = true
+			}
+		case "mark":
+			// Marks are how ip rules and liveStatus tell interfaces apart
+			marks := make(map[uint8]string)
+			for _, i := range lb.nifs {
+				if i.Mark == 0 {
+					errs = append(errs, fmt.Errorf("load balancer %s mode mark needs a mark on interface %s", lb.Name, i.Name))
+				} else if other, found := marks[i.Mark]; found {
+					errs = append(errs, fmt.Errorf("load balancer %s interfaces %s and %s share mark %#x", lb.Name, other, i.Name, i.Mark))
+				} else {
+					marks[i.Mark] = i.Name
+				}
+			}
+		default:
+			errs = append(errs, fmt.Errorf("load balancer %s unknown mode %s, want goto or mark", lb.Name, lb.Mode))
+		}
+		for _, name := range lb.Interfaces {
+			found := contains(conf.disabled, name)
+			for _, i := range conf.Interfaces {
+				found = found || i.Name == name
+			}
+			if !found {
+				errs = append(errs, fmt.Errorf("load balancer %s lists unknown interface %s", lb.Name, name))
+			}
+		}
+	}
+	if conf.startupGrace < 0 {
+		errs = append(errs, fmt.Errorf("startupGrace %s is negative", conf.startupGrace))
+	}
+	if conf.maxTimeOut < conf.minTimeOut {
+		errs = append(errs, fmt.Errorf("maximumTimeOut %s is less than minimumTimeOut %s", conf.maxTimeOut, conf.minTimeOut))
+	}
+	switch conf.CleanupOnExit {
+	case "", "leave", "flush", "all":
+	default:
+		errs = append(errs, fmt.Errorf("unknown cleanupOnExit %s, want leave, flush or all", conf.CleanupOnExit))
+	}
+	switch conf.AllDownPolicy {
+	case "", "keep", "all":
+	case "fallback":
+		if conf.FallbackTarget == "" {
+			errs = append(errs, errors.New("allDownPolicy fallback needs a fallbackTarget chain"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown allDownPolicy %s, want keep, fallback or all", conf.AllDownPolicy))
+	}
+	if conf.MinHealthyIfaces < 0 || conf.MinHealthyIfaces > len(conf.Interfaces) {
+		errs = append(errs, fmt.Errorf("minHealthyInterfaces %d must be between 0 and %d",
+			conf.MinHealthyIfaces, len(conf.Interfaces)))
+	}
+	for n, i := range conf.Interfaces {
+		if i.Name == "" {
+			errs = append(errs, fmt.Errorf("interface %d has no name", n))
+		}
+		if i.Target == "" && needsTarget[i.Name] {
+			errs = append(errs, fmt.Errorf("interface %s has no target", i.Name))
+		}
+		for _, a := range i.expectedAddresses() {
+			if _, _, err := net.ParseCIDR(a); err != nil {
+				errs = append(errs, fmt.Errorf("interface %s address %s is not an address with prefix (e.g. 10.0.0.1/24)", i.Name, a))
+			}
+		}
+		if i.Gateway != "" && net.ParseIP(i.Gateway) == nil {
+			errs = append(errs, fmt.Errorf("interface %s gateway %s is not an IP address", i.Name, i.Gateway))
+		}
+		if i.MinHealthyChecks < 0 || i.MinHealthyChecks > len(i.Checks) {
+			errs = append(errs, fmt.Errorf("interface %s minHealthyChecks %d must be between 0 and %d",
+				i.Name, i.MinHealthyChecks, len(i.Checks)))
+		}
+		if i.MinHealthyWeight < 0 {
+			errs = append(errs, fmt.Errorf("interface %s minHealthyWeight %d is negative", i.Name, i.MinHealthyWeight))
+		}
+		if i.MinTrafficBytes < 0 {
+			errs = append(errs, fmt.Errorf("interface %s minTrafficBytes %d is negative", i.Name, i.MinTrafficBytes))
+		}
+		if i.interval <= 0 {
+			errs = append(errs, fmt.Errorf("interface %s interval %s must be positive", i.Name, i.interval))
+		}
+		if i.ExpectRoute != "" {
+			if _, err := parseExpectRoute(i.ExpectRoute); err != nil {
+				errs = append(errs, fmt.Errorf("interface %s %v", i.Name, err))
+			}
+		}
+		if i.IPv6Prefix != "" && (i.ipv6Prefix == nil || i.ipv6Prefix.IP.To4() != nil) {
+			errs = append(errs, fmt.Errorf("interface %s ipv6Prefix %s is not an IPv6 prefix", i.Name, i.IPv6Prefix))
+		}
+		if i.ExpectRouteTable < 0 {
+			errs = append(errs, fmt.Errorf("interface %s expectRouteTable %d is negative", i.Name, i.ExpectRouteTable))
+		}
+		if _, found := verdictKinds[i.Verdict]; !found {
+			errs = append(errs, fmt.Errorf("interface %s unknown verdict %s, want goto, jump or accept", i.Name, i.Verdict))
+		} else if i.Verdict != "accept" && i.Target == "" && needsTarget[i.Name] {
+			errs = append(errs, fmt.Errorf("interface %s verdict %s needs a target", i.Name, i.Verdict))
+		}
+		if i.Ratio <= 0 {
+			errs = append(errs, fmt.Errorf("interface %s ratio %d must be greater than 0", i.Name, i.Ratio))
+		}
+		switch i.WGEndpointCheck {
+		case "", "udp", "icmp":
+		case "tcp":
+			if i.WGEndpointPort == "" {
+				errs = append(errs, fmt.Errorf("interface %s wgEndpointCheck tcp needs wgEndpointPort", i.Name))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("interface %s wgEndpointCheck %q not one of udp, icmp, tcp", i.Name, i.WGEndpointCheck))
+		}
+		if len(i.OnHealthy) > 0 && i.OnHealthy[0] == "" {
+			errs = append(errs, fmt.Errorf("interface %s onHealthy has an empty command", i.Name))
+		}
+		if len(i.OnUnhealthy) > 0 && i.OnUnhealthy[0] == "" {
+			errs = append(errs, fmt.Errorf("interface %s onUnhealthy has an empty command", i.Name))
+		}
+		if i.WGReflector != "" {
+			if !i.Wireguard {
+				errs = append(errs, fmt.Errorf("interface %s wgReflector needs wireguard", i.Name))
+			} else if !strings.HasPrefix(i.WGReflector, "http://") && !strings.HasPrefix(i.WGReflector, "https://") {
+				errs = append(errs, fmt.Errorf("interface %s wgReflector %s must be an http or https URL", i.Name, i.WGReflector))
+			}
+		}
+
+		for _, c := range i.Checks {
+			if !checkTypes[c.Type] {
+				errs = append(errs, fmt.Errorf("check %s %s has unknown type %q", i.Name, c.Name, c.Type))
+			}
+			if ((c.Type == "http" && c.TLS) || c.Type == "http3") && c.Host == "" {
+				errs = append(errs, fmt.Errorf("check %s %s uses TLS without a host", i.Name, c.Name))
+			}
+			if c.Type == "exec" && c.Command == "" {
+				errs = append(errs, fmt.Errorf("check %s %s is exec without a command", i.Name, c.Name))
+			}
+			if c.Type == "udp" && (c.Host == "" || c.Port == "") {
+				errs = append(errs, fmt.Errorf("check %s %s is udp without a host and port", i.Name, c.Name))
+			}
+			// A typo in a pattern is a config error, not a failed path
+			if _, err := compileRegEx(c.MatchRegEx); err != nil {
+				errs = append(errs, fmt.Errorf("check %s %s bad matchRegEx %s: %v", i.Name, c.Name, c.MatchRegEx, err))
+			}
+			if _, err := compileRegEx(c.ExpectRegEx); err != nil {
+				errs = append(errs, fmt.Errorf("check %s %s bad expectRegEx %s: %v", i.Name, c.Name, c.ExpectRegEx, err))
+			}
+			if c.RetryBackoff != "fixed" && c.RetryBackoff != "exponential" {
+				errs = append(errs, fmt.Errorf("check %s %s unknown retryBackoff %s, want fixed or exponential", i.Name, c.Name, c.RetryBackoff))
+			}
+			if c.RetryBackoff == "exponential" && c.retryBackoffMax < c.reqInterval {
+				errs = append(errs, fmt.Errorf("check %s %s retryBackoffMax %s is less than the interval %s", i.Name, c.Name, c.retryBackoffMax, c.reqInterval))
+			}
+			if c.FailuresToUnhealthy < 1 {
+				errs = append(errs, fmt.Errorf("check %s %s failuresToUnhealthy %d must be at least 1", i.Name, c.Name, c.FailuresToUnhealthy))
+			}
+			if c.MaxBodyBytes < 0 {
+				errs = append(errs, fmt.Errorf("check %s %s maxBodyBytes %d is negative", i.Name, c.Name, c.MaxBodyBytes))
+			}
+			if c.WarmupPings < 0 {
+				errs = append(errs, fmt.Errorf("check %s %s warmupPings %d is negative", i.Name, c.Name, c.WarmupPings))
+			}
+			if c.PacketSize != 0 && (c.PacketSize < minPacketSize || c.PacketSize > maxPacketSize) {
+				errs = append(errs, fmt.Errorf("check %s %s packetSize %d not within %d-%d", i.Name, c.Name, c.PacketSize, minPacketSize, maxPacketSize))
+			}
+			if c.MaxRTTDeviation != 0 && c.MaxRTTDeviation <= 1 {
+				errs = append(errs, fmt.Errorf("check %s %s maxRTTDeviation %g must be greater than 1", i.Name, c.Name, c.MaxRTTDeviation))
+			}
+			if c.Weight < 0 {
+				errs = append(errs, fmt.Errorf("check %s %s weight %d is negative", i.Name, c.Name, c.Weight))
+			}
+			if c.SourcePort < 0 || c.SourcePort > 65535 {
+				errs = append(errs, fmt.Errorf("check %s %s sourcePort %d not within 0-65535", i.Name, c.Name, c.SourcePort))
+			}
+			if (c.ClientCertFile == "") != (c.ClientKeyFile == "") {
+				errs = append(errs, fmt.Errorf("check %s %s needs both clientCertFile and clientKeyFile", i.Name, c.Name))
+			} else if c.Type == "http" || c.Type == "http3" || c.Type == "grpc" {
+				if _, err := c.clientTLSConfig(); err != nil {
+					errs = append(errs, fmt.Errorf("check %s %s %v", i.Name, c.Name, err))
+				}
+			}
+			if len(c.ExpectJSON) > 0 && ((c.Type != "http" && c.Type != "http3") || c.Method == "HEAD") {
+				errs = append(errs, fmt.Errorf("check %s %s expectJSON needs an http check with a response body, not HEAD", i.Name, c.Name))
+			}
+			if (c.DisableKeepAlive || c.ReuseConnections) && c.Type != "http" {
+				errs = append(errs, fmt.Errorf("check %s %s disableKeepAlive and reuseConnections only apply to http checks", i.Name, c.Name))
+			}
+			if c.DisableKeepAlive && c.ReuseConnections {
+				errs = append(errs, fmt.Errorf("check %s %s can't set both disableKeepAlive and reuseConnections", i.Name, c.Name))
+			}
+			if c.ForceHTTP2 && (c.Type != "http" || !c.TLS) {
+				errs = append(errs, fmt.Errorf("check %s %s forceHTTP2 needs an http check with TLS, plaintext h2c is not supported", i.Name, c.Name))
+			}
+			if c.Type == "http" || c.Type == "http3" {
+				if _, err := parseResponseCodes(c.ResponseCode, c.ResponseCodes); err != nil {
+					errs = append(errs, fmt.Errorf("check %s %s %v", i.Name, c.Name, err))
+				}
+			}
+			if c.Type == "icmp" && (c.MaxLossPcnt < 0 || c.MaxLossPcnt > 100) {
+				errs = append(errs, fmt.Errorf("check %s %s maxlosspcnt %v not within 0-100", i.Name, c.Name, c.MaxLossPcnt))
+			}
 		}
 	}
+
+	return errs
 }
 
 // Given a wanted duration string and a fallback default,
@@ -112,3 +738,83 @@ func getDuration(name string, d string, dd string) time.Duration {
 
 	return duration
 }
+
+// Inclusive range of HTTP status codes
+type codeRange struct {
+	min, max int
+}
+
+// responseCodes entries as written, a bare code (204) or a range
+// ("200-299"). Decoded by hand since TOML won't put a number in a
+// string, parseResponseCodes checks them
+type responseCodes []string
+
+// Takes a YAML or JSON list of numbers and strings
+func (r *responseCodes) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.SequenceNode {
+		return fmt.Errorf("line %d: responseCodes is not a list", value.Line)
+	}
+	codes := make(responseCodes, 0, len(value.Content))
+	for _, n := range value.Content {
+		if n.Kind != yaml.ScalarNode || (n.Tag != "!!int" && n.Tag != "!!str") {
+			return fmt.Errorf("line %d: response code %q is not a number or range", n.Line, n.Value)
+		}
+		codes = append(codes, n.Value)
+	}
+	*r = codes
+	return nil
+}
+
+// Takes a TOML array of integers and strings
+func (r *responseCodes) UnmarshalTOML(data any) error {
+	list, ok := data.([]any)
+	if !ok {
+		return fmt.Errorf("responseCodes is not an array")
+	}
+	codes := make(responseCodes, 0, len(list))
+	for _, v := range list {
+		switch v := v.(type) {
+		case int64:
+			codes = append(codes, strconv.FormatInt(v, 10))
+		case string:
+			codes = append(codes, v)
+		default:
+			return fmt.Errorf("response code %v is not a number or range", v)
+		}
+	}
+	*r = codes
+	return nil
+}
+
+// Combines responseCode with responseCodes entries, each a
+// single code (204) or an inclusive range ("200-299")
+func parseResponseCodes(code int, codes responseCodes) ([]codeRange, error) {
+	var ranges []codeRange
+	if code != 0 || len(codes) == 0 {
+		ranges = append(ranges, codeRange{code, code})
+	}
+	for _, s := range codes {
+		lo, hi := s, s
+		if n := strings.Index(s, "-"); n > 0 {
+			lo, hi = s[:n], s[n+1:]
+		}
+		min, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, fmt.Errorf("bad response code %q", s)
+		}
+		max, err := strconv.Atoi(strings.TrimSpace(hi))
+		if err != nil || max < min {
+			return nil, fmt.Errorf("bad response code range %q", s)
+		}
+		ranges = append(ranges, codeRange{min, max})
+	}
+	return ranges, nil
+}
+
+// Compiles a check pattern, nil if unset
+func compileRegEx(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
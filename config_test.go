@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Loads conf as the config file, restoring the running config after
+func loadTestConfig(t *testing.T, conf string) []error {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(file, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, savedFile, savedLevel := saveConfig(), configFile, logLevel
+	t.Cleanup(func() {
+		config, interval, tick, probeSem = s.config, s.interval, s.tick, s.probeSem
+		log.SetLevel(s.level)
+		log.SetFormatter(s.formatter)
+		configFile, logLevel = savedFile, savedLevel
+	})
+	configFile, logLevel = file, "panic"
+	return tryLoadConfig()
+}
+
+const regexConfig = `
+lbtable:
+  family: inet
+  name: vpw
+lbchain: lb
+interfaces:
+  - name: lo
+    address: 127.0.0.1/8
+    target: via_lo
+    ratio: 1
+    checks:
+      - name: web
+        type: http
+        host: 127.0.0.1
+        matchRegEx: %s
+`
+
+func TestReloadRecompilesRegEx(t *testing.T) {
+	for _, pattern := range []string{"^ok", "healthy$"} {
+		if errs := loadTestConfig(t, strings.Replace(regexConfig, "%s", pattern, 1)); len(errs) > 0 {
+			t.Fatalf("pattern %s: %v", pattern, errs)
+		}
+		re := config.Interfaces[0].Checks[0].matchRe
+		if re == nil || re.String() != pattern {
+			t.Errorf("loaded pattern %s compiled to %v", pattern, re)
+		}
+	}
+
+	errs := loadTestConfig(t, strings.Replace(regexConfig, "%s", "'(unclosed'", 1))
+	if len(errs) == 0 || !strings.Contains(errs[0].Error(), "bad matchRegEx") {
+		t.Errorf("bad pattern loaded with errors %v", errs)
+	}
+}
+
+func TestRejectedLoadKeepsConfig(t *testing.T) {
+	// Goroutines outside a check run may log through a load
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				log.Debug("logging through a load")
+			}
+		}
+	}()
+
+	logger := log
+	if errs := loadTestConfig(t, strings.Replace(regexConfig, "%s", "^ok", 1)); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	running := config
+	if errs := loadTestConfig(t, strings.Replace(regexConfig, "%s", "'(unclosed'", 1)); len(errs) == 0 {
+		t.Fatal("bad pattern loaded")
+	}
+	if config != running {
+		t.Error("rejected load replaced the running config")
+	}
+	if log != logger {
+		t.Error("load replaced the logger")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Interfaces administratively drained through the status server,
+// by name so they stay drained across reloads. Not persisted,
+// a restart returns every interface to health based routing
+var (
+	drainMu sync.Mutex
+	drained = make(map[string]bool)
+)
+
+// True if the interface was drained for maintenance
+func (i *vpsInterface) isDrained() bool {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	return drained[i.Name]
+}
+
+// POST /drain/{iface} removes an interface from the load
+// balancer regardless of health until undrained
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	setDrained(w, r, "/drain/", true)
+}
+
+// POST /undrain/{iface} returns an interface to health based routing
+func handleUndrain(w http.ResponseWriter, r *http.Request) {
+	setDrained(w, r, "/undrain/", false)
+}
+
+func setDrained(w http.ResponseWriter, r *http.Request, prefix string, drain bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+	if !knownInterface(name) {
+		http.Error(w, fmt.Sprintf("unknown interface %q", name), http.StatusNotFound)
+		return
+	}
+
+	drainMu.Lock()
+	was := drained[name]
+	if drain {
+		drained[name] = true
+	} else {
+		delete(drained, name)
+	}
+	drainMu.Unlock()
+
+	if was != drain {
+		if drain {
+			log.WithField("nif", name).Warn("Interface drained, removing from load balancer on next check")
+		} else {
+			log.WithField("nif", name).Warn("Interface undrained, restoring health based routing on next check")
+		}
+	}
+	fmt.Fprintf(w, "%s drained=%t\n", name, drain)
+}
+
+// True if name is an interface of the loaded config
+func knownInterface(name string) bool {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	for _, i := range historyIfaces {
+		if i.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	eventBuffer       = 16              // Events queued per subscriber before it's dropped
+	eventWriteTimeout = 5 * time.Second // Longest a subscriber may take to read one event
+)
+
+var (
+	eventMu       sync.Mutex
+	eventListener net.Listener
+	eventSubs     = map[*eventSub]bool{}
+)
+
+// A client of eventSocket, fed by its own writer goroutine
+type eventSub struct {
+	conn   net.Conn
+	events chan []byte
+}
+
+// Listens on config.EventSocket, read at startup, and streams each
+// transition event to every connected client as a line of JSON.
+// Failure to listen is logged, the watcher keeps running
+func startEventSocket() {
+	path := config.EventSocket
+
+	// A socket left by an unclean exit blocks the listen
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		log.Errorf("Failed to listen for event subscribers on %s: %+v", path, err)
+		return
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		log.Warnf("Failed to set permissions on event socket %s: %+v", path, err)
+	}
+	eventMu.Lock()
+	eventListener = l
+	eventMu.Unlock()
+
+	log.Infof("Publishing events on %s", path)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Debugf("Event socket %s stopped: %+v", path, err)
+				return
+			}
+			sub := &eventSub{conn: conn, events: make(chan []byte, eventBuffer)}
+			eventMu.Lock()
+			eventSubs[sub] = true
+			n := len(eventSubs)
+			eventMu.Unlock()
+			log.Debugf("Event subscriber connected, %d total", n)
+			go sub.write()
+		}
+	}()
+}
+
+// Writes queued events until the subscriber goes away
+func (s *eventSub) write() {
+	defer s.drop()
+	for line := range s.events {
+		s.conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if _, err := s.conn.Write(line); err != nil {
+			log.Debugf("Event subscriber write failed: %+v", err)
+			return
+		}
+	}
+}
+
+// Disconnects the subscriber, safe to call more than once
+func (s *eventSub) drop() {
+	eventMu.Lock()
+	if eventSubs[s] {
+		delete(eventSubs, s)
+		close(s.events)
+	}
+	eventMu.Unlock()
+	s.conn.Close()
+}
+
+// Queues event for every subscriber without blocking. A subscriber
+// whose queue is full is too slow and is dropped
+func publishEvent(event *transitionEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("Failed to encode event: %+v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	eventMu.Lock()
+	var slow []*eventSub
+	for s := range eventSubs {
+		select {
+		case s.events <- line:
+		default:
+			slow = append(slow, s)
+		}
+	}
+	eventMu.Unlock()
+	for _, s := range slow {
+		log.Warn("Dropping slow event subscriber")
+		s.drop()
+	}
+}
+
+// Stops accepting subscribers and removes the socket
+func stopEventSocket() {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	if eventListener != nil {
+		eventListener.Close()
+	}
+}
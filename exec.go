@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxExecTrace = 1024 // Most command output logged at trace
+)
+
+// Runs a custom command check, passing on exit code 0
+// Optionally matches MatchRegEx against combined stdout/stderr
+//
+// The command runs in its own process group which is killed
+// on timeout so children aren't leaked
+func (c *vpsHealthCheck) checkExec(ctx context.Context) bool {
+	// Compiled at config load, nil without MatchRegEx
+	re := c.matchRe
+
+	fields := logrus.Fields{
+		"check":   c.Name,
+		"command": c.Command,
+		"args":    c.Args,
+	}
+
+	for i := -1; i < c.Retries && ctx.Err() == nil; i++ {
+		out, err := c.runExec(ctx)
+		log.Tracef("Exec Output for %s: %s", c.Name, trimOutput(out))
+		if err != nil {
+			log.WithFields(fields).WithField("error", err).
+				Warnf("Check Failed Exec attempt %d", i+2)
+			c.sleepRetry(ctx, i+2)
+			continue
+		}
+		if re != nil && !re.Match(out) {
+			log.WithFields(fields).WithField("wantedRegEx", c.MatchRegEx).
+				Warn("Check Failed Exec Output Match")
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// Runs the command once with a timeout, returning combined output
+func (c *vpsHealthCheck) runExec(ctx context.Context) ([]byte, error) {
+	return runCommand(ctx, c.tmout, nil, c.Command, c.Args...)
+}
+
+// Runs a command in its own process group with extra env added to
+// ours, killing the group after tmout. Returns combined output
+func runCommand(ctx context.Context, tmout time.Duration, env []string, name string, args ...string) ([]byte, error) {
+	var out bytes.Buffer
+	cmd := exec.Command(name, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tmout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return out.Bytes(), err
+	case <-ctx.Done():
+		// Kill the whole group, then reap
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return out.Bytes(), errors.New("timed out after " + tmout.String())
+	}
+}
+
+// Trims command output for logging
+func trimOutput(out []byte) string {
+	s := strings.TrimSpace(string(out))
+	if len(s) > maxExecTrace {
+		s = s[:maxExecTrace] + "..."
+	}
+	return s
+}
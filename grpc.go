@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+const (
+	grpcHealthPath = "/grpc.health.v1.Health/Check"
+	grpcServing    = 1 // grpc.health.v1.HealthCheckResponse.SERVING
+)
+
+// Performs a gRPC Health Checking Protocol check against Host:Port
+// Path is used as the service name, empty checks the server as a whole
+//
+// Supports tls, insecure, timeout, retries and interval. HTTP/2 is
+// negotiated over TLS, or spoken in plaintext (h2c) without it.
+func (c *vpsHealthCheck) checkGRPC(ctx context.Context) bool {
+	// Prepare HTTP/2 Client
+	transport, err := c.grpcTransport()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"check": c.Name,
+			"error": err,
+		}).Warn("Check Failed loading TLS certificates")
+		return false
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   c.tmout,
+	}
+	defer client.CloseIdleConnections()
+	scheme := "http://"
+	if c.TLS {
+		scheme = "https://"
+	}
+	uri := scheme + net.JoinHostPort(c.Host, c.Port) + grpcHealthPath
+
+	fields := logrus.Fields{
+		"check":   c.Name,
+		"uri":     uri,
+		"service": c.Path,
+	}
+
+	for i := -1; i < c.Retries && ctx.Err() == nil; i++ {
+		status, err := grpcHealthCheck(ctx, client, uri, c.Path)
+		if err != nil {
+			log.WithFields(fields).WithField("error", err).
+				Warnf("Check Failed gRPC attempt %d", i+2)
+			c.sleepRetry(ctx, i+2)
+			continue
+		}
+		if status != grpcServing {
+			log.WithFields(fields).WithField("servingStatus", status).
+				Warn("Check Failed gRPC Not Serving")
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// Returns an HTTP/2 transport for the check. With TLS, HTTP/2 is
+// negotiated by ALPN, without it the prior knowledge h2c transport
+// dials a plain connection
+func (c *vpsHealthCheck) grpcTransport() (http.RoundTripper, error) {
+	if !c.TLS {
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return c.dialer().DialContext(ctx, network, addr)
+			},
+		}, nil
+	}
+	tlsConfig, err := c.clientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: c.tmout,
+		ForceAttemptHTTP2:   true,
+		DialContext:         c.dialer().DialContext,
+	}, nil
+}
+
+// Makes a single Health/Check call, returning the serving status
+func grpcHealthCheck(ctx context.Context, client *http.Client, uri string, service string) (uint64, error) {
+	// HealthCheckRequest, service is field 1
+	var msg []byte
+	if service != "" {
+		l := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(l, uint64(len(service)))
+		msg = append([]byte{0x0a}, l[:n]...)
+		msg = append(msg, service...)
+	}
+
+	// Length-prefixed, uncompressed
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, bytes.NewReader(frame))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		return 0, fmt.Errorf("server negotiated %s, gRPC requires HTTP/2", resp.Proto)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected HTTP response %s", resp.Status)
+	}
+
+	// Trailers are only populated once the body is read
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	// Trailers-only responses carry status in the headers
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return 0, fmt.Errorf("grpc-status %s: %s", status, message)
+	}
+
+	if len(body) < 5 {
+		return 0, errors.New("short gRPC response")
+	}
+	if body[0] != 0 {
+		return 0, errors.New("compressed gRPC response unsupported")
+	}
+	size := binary.BigEndian.Uint32(body[1:5])
+	if uint32(len(body)-5) < size {
+		return 0, errors.New("truncated gRPC response")
+	}
+	return parseServingStatus(body[5 : 5+size])
+}
+
+// Decodes HealthCheckResponse, status is field 1
+// Absent status is UNKNOWN (0)
+func parseServingStatus(msg []byte) (uint64, error) {
+	var status uint64
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, errors.New("malformed gRPC response")
+		}
+		msg = msg[n:]
+		switch tag & 0x7 {
+		case 0: // varint
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errors.New("malformed gRPC response")
+			}
+			msg = msg[n:]
+			if tag>>3 == 1 {
+				status = v
+			}
+		case 2: // length-delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return 0, errors.New("malformed gRPC response")
+			}
+			msg = msg[uint64(n)+l:]
+		default:
+			return 0, fmt.Errorf("unexpected wire type %d in gRPC response", tag&0x7)
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Answers Health/Check over plaintext HTTP/2, the "down"
+// service is NOT_SERVING and any other SERVING
+func grpcHealthServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != grpcHealthPath {
+			http.Error(w, "not a health check", http.StatusBadRequest)
+			return
+		}
+		req, _ := io.ReadAll(r.Body)
+		status := byte(grpcServing)
+		if len(req) > 7 && string(req[7:]) == "down" {
+			status = 2
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte{0, 0, 0, 0, 2, 0x08, status})
+		w.Header().Set("Grpc-Status", "0")
+	})
+	srv := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCheckGRPCPlaintext(t *testing.T) {
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(grpcHealthServer(t).URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		service string
+		want    bool
+	}{
+		{"", true},
+		{"up", true},
+		{"down", false},
+	}
+	for _, tt := range tests {
+		c := &vpsHealthCheck{
+			Name:        "grpc",
+			Type:        "grpc",
+			Host:        host,
+			Port:        port,
+			Path:        tt.service,
+			tmout:       time.Second,
+			reqInterval: 10 * time.Millisecond,
+		}
+		if got := c.checkGRPC(context.Background()); got != tt.want {
+			t.Errorf("service %q checked %v, want %v", tt.service, got, tt.want)
+		}
+	}
+}
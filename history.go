@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	historyMu     sync.Mutex
+	historyIfaces []*vpsInterface // Interfaces of the loaded config, for the status server
+)
+
+// Outcome of one check cycle, kept per interface up to historyDepth
+type checkResult struct {
+	Time      time.Time          `json:"time"`
+	Healthy   bool               `json:"healthy"`
+	Reasons   []string           `json:"reasons,omitempty"`
+	LatencyMS map[string]float64 `json:"latencyMs,omitempty"`
+}
+
+// Appends the finished cycle's result, dropping the
+// oldest once historyDepth is reached
+func (i *vpsInterface) recordHistory(healthy bool, reasons []string) {
+	if config.HistoryDepth <= 0 {
+		return
+	}
+	result := checkResult{
+		Time:    i.status.time,
+		Healthy: healthy,
+		Reasons: reasons,
+	}
+	i.status.mu.Lock()
+	if len(i.status.latency) > 0 {
+		result.LatencyMS = make(map[string]float64, len(i.status.latency))
+		for n, l := range i.status.latency {
+			result.LatencyMS[n] = float64(l) / float64(time.Millisecond)
+		}
+	}
+	i.status.mu.Unlock()
+
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	i.history = append(i.history, result)
+	if over := len(i.history) - config.HistoryDepth; over > 0 {
+		i.history = append(i.history[:0:0], i.history[over:]...)
+	}
+}
+
+// Publishes freshly loaded interfaces to the status server,
+// carrying over history for interfaces that kept their name
+func publishHistory(interfaces []*vpsInterface) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	for _, i := range interfaces {
+		for _, old := range historyIfaces {
+			if old.Name == i.Name {
+				i.history = old.history
+				if over := len(i.history) - config.HistoryDepth; over > 0 {
+					i.history = i.history[over:]
+				}
+				if config.KeepUnhealthyTotal {
+					i.totalUnhealthy = old.totalUnhealthy
+					i.downtimeStart = old.downtimeStart
+					i.lastCycle = old.lastCycle
+				}
+				break
+			}
+		}
+	}
+	historyIfaces = interfaces
+}
+
+// Adds the time since the previous cycle to totalUnhealthy if the
+// interface was found unhealthy, or skipped while in time out
+func (i *vpsInterface) recordDowntime(now time.Time, unhealthy bool) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if i.downtimeStart.IsZero() {
+		i.downtimeStart = now
+	}
+	if unhealthy && !i.lastCycle.IsZero() {
+		i.totalUnhealthy += now.Sub(i.lastCycle)
+	}
+	i.lastCycle = now
+}
+
+// Cumulative unhealthy time and when accounting started
+func (i *vpsInterface) getDowntime() (time.Duration, time.Time) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	return i.totalUnhealthy, i.downtimeStart
+}
+
+// Copy of the recorded history, oldest first
+func (i *vpsInterface) getHistory() []checkResult {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	return append([]checkResult(nil), i.history...)
+}
+
+// Serves each interface's recent results as JSON, keyed by name
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	history := make(map[string][]checkResult)
+	historyMu.Lock()
+	for _, i := range historyIfaces {
+		history[i.Name] = append([]checkResult(nil), i.history...)
+	}
+	historyMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// One line per result for the SIGUSR1 dump
+func (r checkResult) String() string {
+	s := r.Time.Format(time.RFC3339) + " " + passFail(r.Healthy)
+	if len(r.Reasons) > 0 {
+		s += " " + strings.Join(r.Reasons, ",")
+	}
+	return s
+}
+
+// Cumulative unhealthy time served by /downtime
+type downtime struct {
+	TotalUnhealthy        string    `json:"totalUnhealthy"`
+	TotalUnhealthySeconds float64   `json:"totalUnhealthySeconds"`
+	Since                 time.Time `json:"since"`
+}
+
+// Serves each interface's cumulative unhealthy time as JSON, keyed by
+// name. Counted since startup, or the last reload unless
+// keepUnhealthyTotal is set
+func handleDowntime(w http.ResponseWriter, r *http.Request) {
+	totals := make(map[string]downtime)
+	historyMu.Lock()
+	for _, i := range historyIfaces {
+		totals[i.Name] = downtime{
+			TotalUnhealthy:        i.totalUnhealthy.String(),
+			TotalUnhealthySeconds: i.totalUnhealthy.Seconds(),
+			Since:                 i.downtimeStart,
+		}
+	}
+	historyMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(totals)
+}
+
+// Escapes a Prometheus label value
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Serves each interface's cumulative unhealthy time in the Prometheus
+// text format. The counter resets with /downtime, on reload unless
+// keepUnhealthyTotal is set, which Prometheus treats as a restart
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintln(w, "# HELP vps_path_watcher_unhealthy_seconds_total Cumulative time the interface was found unhealthy.")
+	fmt.Fprintln(w, "# TYPE vps_path_watcher_unhealthy_seconds_total counter")
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	for _, i := range historyIfaces {
+		fmt.Fprintf(w, "vps_path_watcher_unhealthy_seconds_total{interface=\"%s\"} %g\n",
+			promLabelEscaper.Replace(i.Name), i.totalUnhealthy.Seconds())
+	}
+}
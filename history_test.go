@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleMetrics(t *testing.T) {
+	saved := historyIfaces
+	t.Cleanup(func() { historyIfaces = saved })
+	historyIfaces = []*vpsInterface{
+		{Name: "wg0", totalUnhealthy: 90 * time.Second},
+		{Name: `odd"name`},
+	}
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q, want the Prometheus text format", ct)
+	}
+	want := `# HELP vps_path_watcher_unhealthy_seconds_total Cumulative time the interface was found unhealthy.
+# TYPE vps_path_watcher_unhealthy_seconds_total counter
+vps_path_watcher_unhealthy_seconds_total{interface="wg0"} 90
+vps_path_watcher_unhealthy_seconds_total{interface="odd\"name"} 0
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("metrics\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// True if the applied status routes to the interface
+func (i *vpsInterface) routedBy(status string) bool {
+	switch status {
+	case "all":
+		return true
+	case "", "fallback":
+		return false
+	}
+	return contains(strings.Split(status, "|"), i.Name)
+}
+
+// Runs onHealthy or onUnhealthy for every interface an applied
+// NFTables update added to or removed from routing, in the
+// background so a slow hook can't hold up the next run. Nothing
+// fires when the status before was unknown
+func runServiceHooks(oldStatus, newStatus string) {
+	if oldStatus == "" {
+		return
+	}
+	for _, i := range config.Interfaces {
+		routed := i.routedBy(newStatus)
+		if routed == i.routedBy(oldStatus) {
+			continue
+		}
+		hook, event := i.OnUnhealthy, "unhealthy"
+		if routed {
+			hook, event = i.OnHealthy, "healthy"
+		}
+		if len(hook) == 0 {
+			continue
+		}
+		var reasons []string
+		if i.lastStatus != nil {
+			_, reasons = i.lastStatus.healthy()
+		}
+		env := []string{
+			"VPW_INTERFACE=" + i.Name,
+			"VPW_EVENT=" + event,
+			"VPW_REASONS=" + strings.Join(reasons, ","),
+			"VPW_STATUS=" + newStatus,
+		}
+		go runHook(i.Name, event, hook, env, config.hookTimeout)
+	}
+}
+
+// Runs a transition hook, killing it after tmout. It may outlive
+// a reload, so it's handed the timeout rather than reading config
+func runHook(nif, event string, hook []string, env []string, tmout time.Duration) {
+	fields := logrus.Fields{
+		"nif":     nif,
+		"event":   event,
+		"command": hook,
+	}
+	out, err := runCommand(context.Background(), tmout, env, hook[0], hook[1:]...)
+	if s := trimOutput(out); s != "" {
+		fields["output"] = s
+	}
+	if err != nil {
+		log.WithFields(fields).WithField("error", err).Error("Transition hook failed")
+		return
+	}
+	log.WithFields(fields).Infof("Ran %s hook", event)
+}
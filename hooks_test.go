@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServiceHookOutlivesReload(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "ran")
+	savedConfig := config
+	t.Cleanup(func() { config = savedConfig })
+	config = &vpsInstance{
+		hookTimeout: time.Second,
+		Interfaces: []*vpsInterface{{
+			Name:      "wg0",
+			OnHealthy: []string{"sh", "-c", "sleep 0.1; echo $VPW_EVENT > " + marker},
+		}},
+	}
+	runServiceHooks("fallback", "all")
+
+	// A reload swaps the config while the hook runs
+	config = &vpsInstance{}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if out, err := ioutil.ReadFile(marker); err == nil && string(out) == "healthy\n" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("onHealthy hook didn't run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/sirupsen/logrus"
+)
+
+// Performs an HTTP/3 health check over QUIC, judged like an http
+// check on response codes, matchRegEx and expectJSON
+//
+// QUIC always runs TLS, so tls is implied and insecure skips
+// verification. A failed QUIC handshake fails the attempt like a
+// refused connection, and is retried the same way
+func (c *vpsHealthCheck) checkHTTP3(ctx context.Context) bool {
+	tlsConfig, err := c.clientTLSConfig()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"check": c.Name,
+			"error": err,
+		}).Warn("Check Failed loading TLS certificates")
+		return false
+	}
+
+	// Each run dials its own sockets, closed after the transport
+	var sockets []net.PacketConn
+	defer func() {
+		for _, s := range sockets {
+			s.Close()
+		}
+	}()
+	transport := &http3.Transport{
+		TLSClientConfig: tlsConfig,
+		QUICConfig:      &quic.Config{HandshakeIdleTimeout: c.tmout},
+		Dial: func(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (*quic.Conn, error) {
+			conn, raddr, err := c.quicSocket(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			sockets = append(sockets, conn)
+			return quic.DialEarly(ctx, conn, raddr, tlsConf, quicConf)
+		},
+	}
+	defer transport.Close()
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   c.tmout,
+	}
+	return c.requestHTTP(ctx, client, "https://"+c.Host+c.Path)
+}
+
+// Resolves addr and opens an unconnected UDP socket for QUIC to it,
+// sourced from the interface address and marked like the check's
+// other sockets
+func (c *vpsHealthCheck) quicSocket(ctx context.Context, addr string) (net.PacketConn, *net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	resolver := c.resolver()
+	portNum, err := resolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A bound source only reaches its own address family
+	var raddr *net.UDPAddr
+	for _, a := range addrs {
+		if c.srcIP == nil || (a.IP.To4() == nil) == (c.srcIP.To4() == nil) {
+			raddr = &net.UDPAddr{IP: a.IP, Port: portNum, Zone: a.Zone}
+			break
+		}
+	}
+	if raddr == nil {
+		return nil, nil, fmt.Errorf("no usable address for %s", host)
+	}
+
+	lc := net.ListenConfig{}
+	if c.SocketMark != 0 || c.SourcePort != 0 {
+		lc.Control = c.controlSocket
+	}
+	local := &net.UDPAddr{IP: c.srcIP, Port: c.SourcePort}
+	conn, err := lc.ListenPacket(ctx, "udp", local.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, raddr, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Serves HTTP/3 on a loopback UDP port with httptest's self-signed
+// certificate, answering "healthy" with 200
+func http3Server(t *testing.T) string {
+	t.Helper()
+	cert := httptest.NewTLSServer(http.NotFoundHandler())
+	cert.Close()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: cert.TLS.Certificates}),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("healthy"))
+		}),
+	}
+	go srv.Serve(conn)
+	t.Cleanup(func() {
+		srv.Close()
+		conn.Close()
+	})
+	return conn.LocalAddr().String()
+}
+
+func TestCheckHTTP3(t *testing.T) {
+	addr := http3Server(t)
+	tests := []struct {
+		name     string
+		code     int
+		regex    string
+		insecure bool
+		want     bool
+	}{
+		{"matching code", 200, "", true, true},
+		{"matching body", 200, "^healthy", true, true},
+		{"non-matching code", 204, "", true, false},
+		{"non-matching body", 200, "^sick", true, false},
+		{"untrusted certificate", 200, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &vpsHealthCheck{
+				Name:          "h3",
+				Type:          "http3",
+				Host:          addr,
+				Path:          "/healthz",
+				Method:        http.MethodGet,
+				Insecure:      tt.insecure,
+				MatchRegEx:    tt.regex,
+				MaxBodyBytes:  defMaxBodyBytes,
+				responseCodes: []codeRange{{tt.code, tt.code}},
+				tmout:         time.Second,
+				reqInterval:   10 * time.Millisecond,
+			}
+			c.matchRe, _ = compileRegEx(tt.regex)
+			if got := c.checkHTTP3(context.Background()); got != tt.want {
+				t.Errorf("checkHTTP3() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
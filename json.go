@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Compares each ExpectJSON path against the decoded body, returning
+// the first mismatch. Paths are dot separated keys with an optional
+// leading dot, and numeric segments index arrays, e.g. .status or
+// checks.db.0.status. Scalars compare by their JSON text, so
+// numbers and booleans are written as in the body
+func matchJSON(body []byte, expect map[string]string) error {
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return fmt.Errorf("body is not JSON: %v", err)
+	}
+	// Sorted so the reported mismatch is stable
+	paths := make([]string, 0, len(expect))
+	for path := range expect {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		v, err := jsonLookup(doc, path)
+		if err != nil {
+			return err
+		}
+		got, ok := jsonScalar(v)
+		if !ok {
+			return fmt.Errorf("%s is not a scalar", path)
+		}
+		if got != expect[path] {
+			return fmt.Errorf("%s is %q, wanted %q", path, got, expect[path])
+		}
+	}
+	return nil
+}
+
+// Walks path through decoded JSON
+func jsonLookup(doc any, path string) (any, error) {
+	v := doc
+	for _, key := range jsonPath(path) {
+		switch node := v.(type) {
+		case map[string]any:
+			next, ok := node[key]
+			if !ok {
+				return nil, fmt.Errorf("%s not found", path)
+			}
+			v = next
+		case []any:
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 0 || n >= len(node) {
+				return nil, fmt.Errorf("%s index %s out of range", path, key)
+			}
+			v = node[n]
+		default:
+			return nil, fmt.Errorf("%s not found", path)
+		}
+	}
+	return v, nil
+}
+
+// Splits an ExpectJSON path into keys, empty for the document root
+func jsonPath(path string) []string {
+	path = strings.TrimPrefix(path, ".")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// Formats a decoded JSON scalar, false for objects and arrays
+func jsonScalar(v any) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(s), true
+	case nil:
+		return "null", true
+	}
+	return "", false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	probeSem       chan struct{} // Bounds probes across interfaces, nil without maxConcurrentChecks
+	probesInFlight int32         // Probes running now, read with atomic
+	probesPeak     int32         // Most probes in flight since takePeakProbes
+)
+
+// Runs the check once a probe slot is free. Waiting counts
+// against the tick deadline, a check that runs out of time
+// queueing fails like one that ran out of time probing
+func (c *vpsHealthCheck) limitedRun(ctx context.Context) (success, known bool) {
+	if !checkTypes[c.Type] {
+		return c.run(ctx)
+	}
+	release, ok := acquireProbe(ctx, c.Name)
+	if !ok {
+		return false, true
+	}
+	defer release()
+	return c.run(ctx)
+}
+
+// Takes a probe slot for the named probe, waiting until ctx is
+// done. Probes outside limitedRun, like the wireguard endpoint
+// probe, take one directly. Unless false, call release when done
+func acquireProbe(ctx context.Context, name string) (release func(), ok bool) {
+	if probeSem != nil {
+		select {
+		case probeSem <- struct{}{}:
+		case <-ctx.Done():
+			log.WithFields(logrus.Fields{
+				"check":               name,
+				"maxConcurrentChecks": config.MaxConcurrentChecks,
+			}).Warn("Check Failed waiting for a probe slot")
+			return nil, false
+		}
+	}
+	sem := probeSem // A reload may replace it before release
+	n := atomic.AddInt32(&probesInFlight, 1)
+	for peak := atomic.LoadInt32(&probesPeak); n > peak; peak = atomic.LoadInt32(&probesPeak) {
+		if atomic.CompareAndSwapInt32(&probesPeak, peak, n) {
+			break
+		}
+	}
+	return func() {
+		atomic.AddInt32(&probesInFlight, -1)
+		if sem != nil {
+			<-sem
+		}
+	}, true
+}
+
+// Probes running now, for status
+func inFlightProbes() int {
+	return int(atomic.LoadInt32(&probesInFlight))
+}
+
+// Most probes in flight at once since the last call, checks
+// are done by export time so the current count reads as 0
+func takePeakProbes() int {
+	return int(atomic.SwapInt32(&probesPeak, 0))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Rotating log file, nil while logging to stderr
+var logOutput *lumberjack.Logger
+
+// Points the logger at config.LogFile, or back to stderr without one.
+//
+// Run on every load, the file is closed so the next write reopens it,
+// which picks up files moved by logrotate after SIGHUP. Changed
+// rotation options start a new writer. Reopening also prunes backups
+// past logMaxBackups or logMaxAge, so they're enforced on a quiet file
+func openLogFile() {
+	if config.LogFile == "" {
+		if logOutput != nil {
+			log.SetOutput(os.Stderr)
+			logOutput.Close()
+			logOutput = nil
+		}
+		return
+	}
+
+	if logOutput != nil {
+		logOutput.Close()
+	}
+	if logOutput == nil || logOutput.Filename != config.LogFile ||
+		logOutput.MaxSize != config.LogMaxSize ||
+		logOutput.MaxBackups != config.LogMaxBackups ||
+		logOutput.MaxAge != config.LogMaxAge {
+		logOutput = &lumberjack.Logger{
+			Filename:   config.LogFile,
+			MaxSize:    config.LogMaxSize,
+			MaxBackups: config.LogMaxBackups,
+			MaxAge:     config.LogMaxAge,
+			LocalTime:  true,
+		}
+	}
+
+	// Opens right away to surface errors
+	if _, err := logOutput.Write(nil); err != nil {
+		log.SetOutput(os.Stderr)
+		log.Errorf("Failed to open log file %s, logging to stderr: %+v", config.LogFile, err)
+		return
+	}
+	log.SetOutput(logOutput)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogFileRotatesAndPrunes(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "watcher.log")
+	stale := filepath.Join(dir, "watcher-2000-01-01T00-00-00.000.log")
+	if err := ioutil.WriteFile(stale, []byte("old\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	savedConfig, savedLog := config, log
+	t.Cleanup(func() {
+		if logOutput != nil {
+			logOutput.Close()
+			logOutput = nil
+		}
+		config, log = savedConfig, savedLog
+	})
+	log = logrus.New()
+	config = &vpsInstance{LogFile: file, LogMaxSize: 1, LogMaxAge: 1}
+
+	// Loading prunes backups past logMaxAge without any writes
+	openLogFile()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(stale); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stale backup not pruned on load")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Writes past logMaxSize start a new file
+	line := make([]byte, 1024)
+	for n := 0; n < 1100; n++ {
+		if _, err := logOutput.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, _ := filepath.Glob(filepath.Join(dir, "watcher-*.log"))
+	if len(backups) != 1 {
+		t.Errorf("rotated into backups %v, want one", backups)
+	}
+
+	// Without logFile, logs return to stderr
+	config.LogFile = ""
+	openLogFile()
+	if logOutput != nil {
+		t.Error("log file still open without logFile")
+	}
+}
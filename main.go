@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"math/rand"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -15,38 +20,93 @@ import (
 var (
 	wg            sync.WaitGroup
 	currentStatus string
+	desiredStatus string // Status wanted by the last checkInterfaces, may differ if NFTables failed
+	testChecks    bool
+	printConf     bool
+	showVersion   bool
+	jitterRand    = rand.New(rand.NewSource(time.Now().UnixNano())) // Only used from checkInterfaces
+	checksRunning int32                                             // Set while checkInterfaces runs, see checkInterfaces
+	started       = time.Now()                                      // Start of the process, for startupGrace
 )
 
-func init() {
-	flag.StringVar(&configFile, "config", configFile, "Path to config yaml")
+// Parses flags, loads config and prepares NFTables. Run from main
+// rather than init so tests don't start the watcher
+func setup() {
+	flag.StringVar(&configFile, "config", configFile, "Path to config yaml, a directory of them, or a comma separated list")
 	flag.StringVar(&logLevel, "logLevel", logLevel, "Default logging level")
+	flag.StringVar(&logFormat, "logFormat", logFormat, "Log format, text or json (overrides config)")
+	flag.BoolVar(&dryRun, "dry-run", dryRun, "Log NFTables changes without applying them")
+	flag.BoolVar(&testChecks, "test", testChecks, "Run all checks once, print a report, and exit")
+	flag.BoolVar(&printConf, "print-config", printConf, "Print the config with defaults and durations resolved, then exit")
+	flag.BoolVar(&showVersion, "version", showVersion, "Print version and build info, then exit")
 	flag.Parse()
 
+	// Before touching config or NFTables
+	if showVersion {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+
 	// Load config from file
 	loadConfig()
 	log.Debugf("Yaml Config: %+v", config)
 
+	// Validated by loading, NFTables is never touched
+	if printConf {
+		os.Exit(printConfig())
+	}
+
+	// Test checks without touching NFTables
+	if testChecks {
+		resetHealth()
+		os.Exit(runTestChecks())
+	}
+
 	// Prepare NFTables
-	initNFT()
+	if err := initNFT(); err != nil {
+		log.Fatalf("Failed to prepare NFTables: %+v", err)
+	}
 
 	// Prepare health status
 	resetHealth()
+
+	// Let systemd know we're up
+	sdNotify("READY=1")
 }
 
 func main() {
-	log.Info("VPS Path Watcher Ready")
+	setup()
+	log.WithField("version", versionString()).Info("VPS Path Watcher Ready")
 
 	// Handle signals
-	die := make(chan os.Signal)
-	hup := make(chan os.Signal)
+	die := make(chan os.Signal, 1)
+	hup := make(chan os.Signal, 1)
+	usr1 := make(chan os.Signal, 1)
 	signal.Notify(die, syscall.SIGINT, syscall.SIGTERM)
 	signal.Notify(hup, syscall.SIGHUP)
+	signal.Notify(usr1, syscall.SIGUSR1)
+
+	// Optionally reload when the config file changes
+	reload := make(chan struct{}, 1)
+	watchConfig(reload)
 
-	// Run every config.interval seconds
-	ticker := time.NewTicker(interval)
+	// Optionally serve process status
+	if config.StatusListen != "" {
+		startStatusServer()
+	}
+
+	// Optionally stream transitions to local subscribers
+	if config.EventSocket != "" {
+		startEventSocket()
+	}
+
+	// Run at the shortest interface interval,
+	// each interface is checked once it's due
+	ticker := time.NewTicker(tick)
 	defer ticker.Stop()
 
 	// Don't wait for first tick to run
+	wg.Add(1)
 	checkInterfaces()
 
 	// Update forever
@@ -54,118 +114,481 @@ func main() {
 		select {
 		case <-hup:
 			log.Warn("Received SIGHUP, waiting on goroutines then reloading config.")
-			wg.Wait()
-			loadConfig()
-			initNFT()
-			resetHealth()
+			reloadConfig()
+			ticker.Reset(tick)
+			watchConfig(reload)
+		case <-reload:
+			log.Warn("Config file changed, waiting on goroutines then reloading config.")
+			reloadConfig()
+			ticker.Reset(tick)
+			watchConfig(reload)
+		case reply := <-reloadRequests:
+			log.Warn("Reload requested, waiting on goroutines then reloading config.")
+			reply <- tryReloadConfig()
+			ticker.Reset(tick)
+			watchConfig(reload)
+		case <-usr1:
+			dumpStatus()
 		case <-die:
 			log.Warn("Asked to die, waiting on goroutines...")
 			wg.Wait()
+			stopWatchingConfig()
+			shutdownOTel()
+			cleanupNFT()
+			stopEventSocket()
 			os.Exit(0)
 		case <-ticker.C:
+			// Added here rather than in the goroutine so a
+			// reload's wg.Wait can't miss a starting run
+			wg.Add(1)
 			go checkInterfaces()
 		}
 	}
 }
 
+// Waits on running checks, then reloads config and rebuilds
+// NFTables and health state. A config that fails to load or
+// validate is logged and the running one kept, so a half saved
+// edit can't stop the watcher
+func reloadConfig() {
+	for _, err := range tryReloadConfig() {
+		log.WithField("error", err).Error("Invalid configuration")
+	}
+}
+
+// Reloads as reloadConfig does, returning why a
+// rejected config couldn't be used
+func tryReloadConfig() []error {
+	wg.Wait()
+	saved := saveConfig()
+	if errs := tryLoadConfig(); len(errs) > 0 {
+		log.WithField("errors", len(errs)).Errorf("Rejected config %s, keeping the running config", configFile)
+		return errs
+	}
+	if err := initNFT(); err != nil {
+		saved.restore()
+		log.WithField("error", err).Errorf("Failed to prepare NFTables for config %s, keeping the running config", configFile)
+		return []error{err}
+	}
+	resetHealth()
+	log.Infof("Reloaded config %s", configFile)
+	return nil
+}
+
+// Logs each interface's last results and penalty box state
+// along with the current and desired NFTables status. Waits on
+// running checks first so shared state isn't read mid-update
+func dumpStatus() {
+	wg.Wait()
+	log.WithFields(logrus.Fields{
+		"currentStatus":  currentStatus,
+		"desiredStatus":  desiredStatus,
+		"probesInFlight": inFlightProbes(),
+	}).Info("Status Summary")
+	for _, lb := range config.LoadBalancers {
+		log.WithFields(logrus.Fields{
+			"lb":     lb.Name,
+			"table":  lb.Table.Name,
+			"chain":  lb.Chain,
+			"status": lb.status,
+		}).Info("Load Balancer Status")
+	}
+	for _, i := range config.Interfaces {
+		fields := logrus.Fields{
+			"nif":           i.Name,
+			"inService":     i.inService,
+			"drained":       i.isDrained(),
+			"lastUnhealthy": i.lastUnhealthy,
+			"inTimeOut":     i.lastStatus != nil && time.Since(i.lastUnhealthy) < i.timeOut,
+			"timeOut":       i.timeOut,
+		}
+		fields["totalUnhealthy"], fields["downtimeSince"] = i.getDowntime()
+		if s := i.lastStatus; s != nil {
+			s.mu.Lock()
+			healthy, reasons := s.healthy()
+			var checks []string
+			for _, results := range []map[string]bool{s.healthChecks, s.details} {
+				for n, ok := range results {
+					if latency, found := s.latency[n]; found {
+						checks = append(checks, fmt.Sprintf("%s=%s (%s)", n, passFail(ok), latency))
+					} else {
+						checks = append(checks, fmt.Sprintf("%s=%s", n, passFail(ok)))
+					}
+				}
+			}
+			s.mu.Unlock()
+			sort.Strings(checks)
+			fields["healthy"] = healthy
+			fields["reasons"] = reasons
+			fields["exists"] = s.exists
+			fields["up"] = s.up
+			fields["addressed"] = s.addressed
+			fields["checks"] = checks
+			fields["lastCheck"] = s.time
+		}
+		log.WithFields(fields).Info("Interface Status")
+		for _, r := range i.getHistory() {
+			log.WithField("nif", i.Name).Infof("Interface History %s", r)
+		}
+	}
+}
+
 // Main Loop
 // Checks each interface for basic health (up,configured)
 // Performs configured health checks
 //
 // Once all checks are complete, takes action on
 // NFTables if necessary
+//
+// Skipped with a warning if the previous run hasn't finished.
+// The caller adds to wg, which is released here
 func checkInterfaces() {
-	wg.Add(1)
-	for _, i := range config.Interfaces {
-		// Make sure interface is due for a check
-		if i.lastStatus != nil {
-			if time.Since(i.lastUnhealthy) < config.minTimeOut {
-				log.WithFields(logrus.Fields{
-					"nif":           i.Name,
-					"lastUnhealthy": i.lastUnhealthy,
-					"lastStatus":    i.lastStatus,
-					"timeElapsed":   time.Since(i.lastUnhealthy),
-				}).Debug("Skipping interface in time out")
-				log.Infof("Skipping interface %s in time out", i.Name)
-				continue
-			}
-		} else {
-			// First check, never unhealthy
-			i.lastUnhealthy = time.Now().Add(-8760 * time.Hour)
-		}
-
-		log.WithFields(logrus.Fields{
-			"nif":    i.Name,
-			"addr":   i.Address,
-			"checks": len(i.Checks),
-		}).Info("Running Interface Checks")
+	defer wg.Done()
+	if !atomic.CompareAndSwapInt32(&checksRunning, 0, 1) {
+		log.Warn("Previous checks still running, skipping this tick")
+		return
+	}
+	defer atomic.StoreInt32(&checksRunning, 0)
+	recordTick()
+	start := time.Now()
 
-		// Check Basic Interface Health
-		i.basicChecks()
+	// Longer TTLs share results across ticks
+	if config.cacheTTL < tick {
+		clearCache()
+	}
 
-		// Only perform additional checks if basic checks
-		// report a healthy interface
-		isHealthy, _ := i.status.healthy()
-		if isHealthy {
-			i.healthChecks()
+	// Check interfaces concurrently, bounded by maxConcurrency,
+	// each optionally delayed by up to jitter to spread probes
+	var checks sync.WaitGroup
+	sem := make(chan struct{}, config.MaxConcurrency)
+	for _, i := range config.Interfaces {
+		// Loosened by half a tick so ticker drift can't push a
+		// check back a whole tick. Skipped interfaces keep their
+		// last verdict
+		if start.Add(tick / 2).Before(i.nextCheck) {
+			log.WithFields(logrus.Fields{
+				"nif":       i.Name,
+				"nextCheck": i.nextCheck,
+			}).Trace("Interface not due for checks")
+			continue
 		}
+		i.nextCheck = start.Add(i.interval)
 
-		// Record last check
-		i.status.time = time.Now()
-		i.lastStatus = i.status // Not used now, but would be nice to show a from -> to debug msg
-
-		// Check Result
-		log.Tracef("Check Results for %s: %+v", i.Name, i.status)
-		healthy, reasons := i.status.healthy()
-		if healthy {
-			log.WithField("nif", i.Name).Info("Checks Complete, Interface Healthy")
-		} else {
-			log.WithFields(logrus.Fields{
-				"nif":     i.Name,
-				"reasons": reasons,
-			}).Warn("Checks Complete, Interface Unhealthy")
-			i.lastUnhealthy = i.status.time
+		var delay time.Duration
+		if config.jitter > 0 {
+			delay = time.Duration(jitterRand.Int63n(int64(config.jitter)))
 		}
+		checks.Add(1)
+		go func(i *vpsInterface, delay time.Duration) {
+			defer checks.Done()
+			if delay > 0 {
+				log.WithFields(logrus.Fields{
+					"nif":   i.Name,
+					"delay": delay,
+				}).Trace("Jittering interface checks")
+				time.Sleep(delay)
+			}
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			// Jittered checks still finish before the next tick
+			deadline := time.Now().Add(config.tickDeadline)
+			if next := start.Add(tick); config.jitter > 0 && next.Before(deadline) {
+				deadline = next
+			}
+			ctx, cancel := context.WithDeadline(context.Background(), deadline)
+			defer cancel()
+			i.check(ctx)
+		}(i, delay)
 	}
+	checks.Wait()
 
 	// Determine Desired Status
-	desiredStatus := currentStatus
+	desiredStatus = currentStatus
 	healthyInterfaces := getHealthyInterfaces()
 	if healthyInterfaces == nil {
-		log.Error("No healthy interfaces, refusing to do anything")
+		switch config.AllDownPolicy {
+		case "all":
+			log.Error("No healthy interfaces, routing to all interfaces anyway")
+			desiredStatus = "all"
+		case "fallback":
+			log.Error("No healthy interfaces, routing to fallback target")
+			desiredStatus = "fallback"
+		default:
+			log.Error("No healthy interfaces, refusing to do anything")
+		}
+	} else if len(healthyInterfaces) < config.MinHealthyIfaces {
+		log.WithFields(logrus.Fields{
+			"healthy":       len(healthyInterfaces),
+			"minHealthy":    config.MinHealthyIfaces,
+			"currentStatus": currentStatus,
+		}).Error("CRITICAL: Too few healthy interfaces, refusing to narrow load balancing")
 	} else if len(healthyInterfaces) < len(config.Interfaces) {
 		var ss []string
 		for _, i := range healthyInterfaces {
 			ss = append(ss, i.Name)
 		}
 		desiredStatus = strings.Join(ss, "|")
-		log.Warnf("Health degraded, healthy interfaces: %s", desiredStatus)
+		log.WithField("status", desiredStatus).Warn("Health degraded")
 	} else {
-		log.Infof("All interfaces up and healthy")
+		log.WithField("status", "all").Info("All interfaces up and healthy")
 		desiredStatus = "all"
 	}
 
-	// Take Action
-	if currentStatus != desiredStatus {
+	// Let paths settle after starting before acting on them
+	if remaining := config.startupGrace - time.Since(started); remaining > 0 {
+		log.WithFields(logrus.Fields{
+			"currentStatus": currentStatus,
+			"desiredStatus": desiredStatus,
+			"remaining":     remaining.Round(time.Second),
+		}).Info("Startup grace period active, not adjusting NFTables")
+	} else if currentStatus != desiredStatus || !lbsSynced(desiredStatus) {
+		// Take Action, also when a load balancer missed its last update
 		log.WithFields(logrus.Fields{
 			"currentStatus": currentStatus,
 			"desiredStatus": desiredStatus,
 		}).Error("Adjusting NFTables Load Balancing")
-		currentStatus = updateNFT(desiredStatus)
+		if err := updateNFT(desiredStatus); err != nil {
+			log.WithField("error", err).Error("Failed to adjust NFTables, will retry next check")
+		} else {
+			oldStatus := currentStatus
+			currentStatus = desiredStatus
+			saveState(currentStatus)
+			if oldStatus != currentStatus {
+				notifyTransition(newTransitionEvent(oldStatus, currentStatus))
+			}
+			// Hooks follow routing, so dry runs never fire them
+			if !config.DryRun {
+				runServiceHooks(oldStatus, currentStatus)
+			}
+		}
 	}
 
+	recordOTelGauges()
 	resetHealth()
-	wg.Done()
+
+	// Completed a run, pet the systemd watchdog
+	sdNotify("WATCHDOG=1")
+}
+
+// Runs basic and configured health checks for an interface
+// Only touches this interface's status, safe to run concurrently
+func (i *vpsInterface) check(ctx context.Context) {
+	// Make sure interface is due for a check
+	first := i.lastStatus == nil
+	if !first {
+		if time.Since(i.lastUnhealthy) < i.timeOut {
+			log.WithFields(logrus.Fields{
+				"nif":           i.Name,
+				"lastUnhealthy": i.lastUnhealthy,
+				"lastStatus":    i.lastStatus,
+				"timeElapsed":   time.Since(i.lastUnhealthy),
+				"timeOut":       i.timeOut,
+			}).Info("Skipping interface in time out")
+			i.recordDowntime(time.Now(), true)
+			return
+		}
+	} else {
+		// First check, never unhealthy
+		i.lastUnhealthy = time.Now().Add(-8760 * time.Hour)
+	}
+
+	log.WithFields(logrus.Fields{
+		"nif":    i.Name,
+		"addr":   i.Address,
+		"checks": len(i.Checks),
+	}).Info("Running Interface Checks")
+
+	// Check Basic Interface Health
+	i.basicChecks(ctx)
+
+	// Only perform additional checks if basic checks
+	// report a healthy interface
+	isHealthy, _ := i.status.healthy()
+	if isHealthy {
+		i.healthChecks(ctx)
+	}
+
+	// Checks cut short by the deadline can't be trusted
+	if ctx.Err() == context.DeadlineExceeded {
+		log.WithFields(logrus.Fields{
+			"nif":          i.Name,
+			"tickDeadline": config.tickDeadline,
+		}).Warn("Check deadline exceeded, treating interface as failed")
+		if i.status.healthChecks == nil {
+			i.status.reset(len(i.Checks))
+		}
+		i.status.setCheck("tick_deadline", false, 0)
+	}
+
+	// Record last check
+	i.status.time = time.Now()
+	i.lastStatus = i.status // Not used now, but would be nice to show a from -> to debug msg
+
+	// Check Result
+	log.Tracef("Check Results for %s: %+v", i.Name, i.status)
+	healthy, reasons := i.status.healthy()
+	if healthy {
+		log.WithFields(logrus.Fields{
+			"nif":     i.Name,
+			"latency": i.status.latency,
+		}).Info("Checks Complete, Interface Healthy")
+	} else {
+		log.WithFields(logrus.Fields{
+			"nif":     i.Name,
+			"reasons": reasons,
+			"latency": i.status.latency,
+		}).Warn("Checks Complete, Interface Unhealthy")
+		i.lastUnhealthy = i.status.time
+	}
+	i.recordHistory(healthy, reasons)
+	i.recordDowntime(i.status.time, !healthy)
+
+	// Decide if the interface should carry traffic
+	i.updateService(healthy, first)
+	i.updateTimeOut(healthy)
+}
+
+// Sets the penalty box for the next check. Consecutive failures
+// double minTimeOut up to maxTimeOut, passing resets it. Logs
+// once a parked interface is back in service
+func (i *vpsInterface) updateTimeOut(healthy bool) {
+	if healthy {
+		if !i.parkedSince.IsZero() && i.inService {
+			log.WithFields(logrus.Fields{
+				"nif":       i.Name,
+				"parkedFor": time.Since(i.parkedSince).Round(time.Second),
+			}).Warn("Interface returned to service from time out")
+			i.parkedSince = time.Time{}
+		}
+		i.timeOut = 0
+		return
+	}
+	if i.parkedSince.IsZero() {
+		i.parkedSince = time.Now()
+	}
+	i.timeOut = config.minTimeOut
+	for n := 1; n < i.unhealthyStreak && i.timeOut < config.maxTimeOut; n++ {
+		i.timeOut *= 2
+	}
+	if i.timeOut > config.maxTimeOut {
+		i.timeOut = config.maxTimeOut
+	}
+	log.WithFields(logrus.Fields{
+		"nif":             i.Name,
+		"unhealthyStreak": i.unhealthyStreak,
+		"timeOut":         i.timeOut,
+	}).Warn("Interface parked in time out")
+}
+
+// Applies hysteresis to a check result. An interface must be healthy
+// for healthyThreshold consecutive checks to return to service, and
+// unhealthy for unhealthyThreshold consecutive checks to be removed.
+// The first check of an interface is taken as-is.
+func (i *vpsInterface) updateService(healthy bool, first bool) {
+	if healthy {
+		i.healthyStreak++
+		i.unhealthyStreak = 0
+	} else {
+		i.unhealthyStreak++
+		i.healthyStreak = 0
+	}
+
+	if first || healthy == i.inService {
+		i.inService = healthy
+		return
+	}
+
+	fields := logrus.Fields{
+		"nif":             i.Name,
+		"healthyStreak":   i.healthyStreak,
+		"unhealthyStreak": i.unhealthyStreak,
+	}
+	if healthy {
+		if i.healthyStreak >= config.HealthyThreshold {
+			log.WithFields(fields).Info("Interface returning to service")
+			i.inService = true
+		} else {
+			log.WithFields(fields).WithField("healthyThreshold", config.HealthyThreshold).
+				Info("Suppressing flap, interface not yet healthy long enough to restore")
+		}
+	} else {
+		if i.unhealthyStreak >= config.UnhealthyThreshold {
+			log.WithFields(fields).Warn("Interface removed from service")
+			i.inService = false
+		} else {
+			log.WithFields(fields).WithField("unhealthyThreshold", config.UnhealthyThreshold).
+				Warn("Suppressing flap, interface not yet unhealthy long enough to remove")
+		}
+	}
 }
 
 // Returns slice of all healthy interfaces
+// Healthy means in service, see updateService
 func getHealthyInterfaces() []*vpsInterface {
 	var healthyInterfaces []*vpsInterface
 	for _, i := range config.Interfaces {
-		healthy, _ := i.status.healthy()
-		if healthy {
+		if i.isDrained() {
+			log.WithFields(logrus.Fields{
+				"nif":       i.Name,
+				"inService": i.inService,
+			}).Info("Interface drained, excluding from load balancer")
+			continue
+		}
+		if i.inService {
 			healthyInterfaces = append(healthyInterfaces, i)
 		}
 	}
 	return healthyInterfaces
 }
+
+// Runs basic and health checks for every interface once and
+// prints a pass/fail report to stdout. Never touches NFTables.
+//
+// Returns the exit code, 0 only if all interfaces are healthy
+func runTestChecks() int {
+	code := 0
+	for _, i := range config.Interfaces {
+		i.basicChecks(context.Background())
+		if healthy, _ := i.status.healthy(); healthy {
+			i.healthChecks(context.Background())
+		}
+
+		healthy, reasons := i.status.healthy()
+		if healthy {
+			fmt.Printf("%s: healthy\n", i.Name)
+		} else {
+			code = 1
+			fmt.Printf("%s: unhealthy (%s)\n", i.Name, strings.Join(reasons, ", "))
+		}
+		fmt.Printf("  exists: %s\n", passFail(i.status.exists))
+		fmt.Printf("  up: %s\n", passFail(i.status.up))
+		fmt.Printf("  addressed: %s\n", passFail(i.status.addressed))
+
+		// Per address results sort right after their check
+		results := make(map[string]bool)
+		var names []string
+		for _, m := range []map[string]bool{i.status.healthChecks, i.status.details} {
+			for n, ok := range m {
+				results[n] = ok
+				names = append(names, n)
+			}
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			if latency, ok := i.status.latency[n]; ok {
+				fmt.Printf("  %s: %s (%s)\n", n, passFail(results[n]), latency)
+			} else {
+				fmt.Printf("  %s: %s\n", n, passFail(results[n]))
+			}
+		}
+	}
+	return code
+}
+
+func passFail(ok bool) string {
+	if ok {
+		return "pass"
+	}
+	return "fail"
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+)
+
+// Keeps the package logger out of test output
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+const inFlightConfig = `
+dryRun: true
+interval: 1s
+lbtable:
+  family: inet
+  name: vpw
+lbchain: lb
+interfaces:
+  - name: lo
+    address: 127.0.0.1/8
+    target: via_lo
+    ratio: 1
+    checks:
+      - name: slow
+        type: exec
+        command: sleep
+        args: ["%s"]
+`
+
+func TestReloadWaitsForInFlightCheck(t *testing.T) {
+	savedOptions, savedCurrent, savedDesired := nftOptions, currentStatus, desiredStatus
+	t.Cleanup(func() {
+		nftOptions, currentStatus, desiredStatus = savedOptions, savedCurrent, savedDesired
+	})
+	// Reads of the ruleset find it empty, dry runs write nothing
+	nftOptions = []nftables.ConnOption{nftables.WithTestDial(func([]netlink.Message) ([]netlink.Message, error) {
+		return nil, io.EOF
+	})}
+
+	if errs := loadTestConfig(t, strings.Replace(inFlightConfig, "%s", "0.3", 1)); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if err := initNFT(); err != nil {
+		t.Fatal(err)
+	}
+	resetHealth()
+
+	// Start a check and reload once it's running
+	wg.Add(1)
+	go checkInterfaces()
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&checksRunning) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("checks never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := ioutil.WriteFile(configFile, []byte(strings.Replace(inFlightConfig, "%s", "0.1", 1)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if errs := tryReloadConfig(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	if atomic.LoadInt32(&checksRunning) != 0 {
+		t.Error("reload returned with checks still running")
+	}
+	if args := config.Interfaces[0].Checks[0].Args; len(args) != 1 || args[0] != "0.1" {
+		t.Errorf("reloaded check args %v, want [0.1]", args)
+	}
+
+	// Checks run against the reloaded config
+	wg.Add(1)
+	checkInterfaces()
+	if s := config.Interfaces[0].lastStatus; s == nil || s.healthChecks["slow"] != true {
+		t.Errorf("reloaded check didn't run, status %+v", s)
+	}
+}
+
+func TestReloadKeepsConfigWhenNFTablesFails(t *testing.T) {
+	savedOptions := nftOptions
+	t.Cleanup(func() { nftOptions = savedOptions })
+	if errs := loadTestConfig(t, strings.Replace(inFlightConfig, "%s", "0.1", 1)); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	running := config
+
+	// No such network namespace, connecting fails
+	nftOptions = []nftables.ConnOption{nftables.AsLasting(), nftables.WithNetNSFd(-1)}
+	errs := tryReloadConfig()
+	if len(errs) == 0 || !strings.Contains(errs[0].Error(), "NFTables") {
+		t.Fatalf("reload without NFTables returned %v", errs)
+	}
+	if config != running {
+		t.Error("failed reload replaced the running config")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Extensions of config files picked up from directories
+var configExts = []string{".yaml", ".yml", ".json", ".toml"}
+
+// Expands configFile into the files to load in order. It may be a
+// comma separated list, and any directory contributes its config
+// files sorted by name
+func configFiles() ([]string, error) {
+	var files []string
+	for _, path := range strings.Split(configFile, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		var found []string
+		for _, ext := range configExts {
+			matches, err := filepath.Glob(filepath.Join(path, "*"+ext))
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, matches...)
+		}
+		sort.Strings(found)
+		files = append(files, found...)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no config files found in %s", configFile)
+	}
+	return files, nil
+}
+
+// Decodes a config file by extension. YAML is a superset of JSON,
+// so JSON configs are read by the YAML decoder and use the same keys.
+// TOML is decoded by its toml tags, which match the YAML keys
+func unmarshalConfig(file string, data []byte, conf *vpsInstance) error {
+	if strings.ToLower(filepath.Ext(file)) == ".toml" {
+		_, err := toml.Decode(string(data), conf)
+		return err
+	}
+	return yaml.Unmarshal(data, conf)
+}
+
+// Lists a later file replaces rather than extends, a hash key
+// or hook argv only makes sense whole
+var replacedLists = []string{"HashKey", "OnHealthy", "OnUnhealthy"}
+
+// Merges a later config file into dst. Set scalars override,
+// lists append unless in replacedLists, and interfaces sharing a Name merge with
+// mergeInterface
+func mergeConfig(dst, src *vpsInstance) error {
+	for _, si := range src.Interfaces {
+		var existing *vpsInterface
+		for _, di := range dst.Interfaces {
+			if di.Name == si.Name {
+				existing = di
+				break
+			}
+		}
+		if existing == nil {
+			dst.Interfaces = append(dst.Interfaces, si)
+			continue
+		}
+		if err := mergeInterface(existing, si); err != nil {
+			return err
+		}
+	}
+	mergeFields(reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem(), "Interfaces")
+	return nil
+}
+
+// Overrides set scalars and appends lists from src into dst,
+// replacing those in replacedLists and skipping the named fields
+func mergeFields(dst, src reflect.Value, skip ...string) {
+	t := dst.Type()
+	for n := 0; n < t.NumField(); n++ {
+		f := t.Field(n)
+		if f.PkgPath != "" || contains(skip, f.Name) {
+			continue
+		}
+		d, s := dst.Field(n), src.Field(n)
+		switch f.Type.Kind() {
+		case reflect.Struct:
+			mergeFields(d, s)
+		case reflect.Slice:
+			if !contains(replacedLists, f.Name) {
+				d.Set(reflect.AppendSlice(d, s))
+			} else if s.Len() > 0 {
+				d.Set(s)
+			}
+		default:
+			if !s.IsZero() {
+				d.Set(s)
+			}
+		}
+	}
+}
+
+// Combines two definitions of the same interface, appending
+// addresses and checks and replacing lists in replacedLists.
+// Setting a field in both files to different values is a conflict
+func mergeInterface(dst, src *vpsInterface) error {
+	dv, sv := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+	t := dv.Type()
+	for n := 0; n < t.NumField(); n++ {
+		f := t.Field(n)
+		if f.PkgPath != "" {
+			continue
+		}
+		d, s := dv.Field(n), sv.Field(n)
+		switch {
+		case f.Type.Kind() == reflect.Slice && contains(replacedLists, f.Name):
+			if s.Len() > 0 {
+				d.Set(s)
+			}
+		case f.Type.Kind() == reflect.Slice:
+			d.Set(reflect.AppendSlice(d, s))
+		case s.IsZero():
+		case d.IsZero():
+			d.Set(s)
+		case !reflect.DeepEqual(d.Interface(), s.Interface()):
+			return fmt.Errorf("interface %s sets %s to both %v and %v",
+				dst.Name, f.Name, d.Interface(), s.Interface())
+		}
+	}
+	return nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The same logical config in each supported format
+var formatConfigs = map[string]string{
+	"config.yaml": `
+interval: 30s
+lbtable:
+  family: inet
+  name: vpw
+lbchain: lb
+hashKey: [saddr, sport]
+interfaces:
+  - name: wg0
+    address: 10.8.0.2/24
+    ratio: 3
+    mark: 1
+    matchAddressExact: false
+    onUnhealthy: ["/usr/local/bin/withdraw", "10.8.0.0/24"]
+    checks:
+      - name: web
+        type: http
+        host: example.com
+        retries: 2
+        maxlosspcnt: 12.5
+        headers:
+          X-Api-Key: secret
+        responseCodes: [200, 204, "300-399"]
+  - name: wg1
+    address: 10.9.0.2/24
+    ratio: 7
+`,
+	"config.json": `{
+  "interval": "30s",
+  "lbtable": {"family": "inet", "name": "vpw"},
+  "lbchain": "lb",
+  "hashKey": ["saddr", "sport"],
+  "interfaces": [
+    {
+      "name": "wg0",
+      "address": "10.8.0.2/24",
+      "ratio": 3,
+      "mark": 1,
+      "matchAddressExact": false,
+      "onUnhealthy": ["/usr/local/bin/withdraw", "10.8.0.0/24"],
+      "checks": [
+        {"name": "web", "type": "http", "host": "example.com", "retries": 2,
+         "maxlosspcnt": 12.5, "headers": {"X-Api-Key": "secret"},
+         "responseCodes": [200, 204, "300-399"]}
+      ]
+    },
+    {"name": "wg1", "address": "10.9.0.2/24", "ratio": 7}
+  ]
+}`,
+	"config.toml": `
+interval = "30s" # global
+lbtable = { family = "inet", name = "vpw" }
+lbchain = 'lb'
+hashKey = [
+  "saddr",
+  "sport", # trailing comma allowed
+]
+
+[[interfaces]]
+name = "wg0"
+address = "10.8.0.2/24"
+ratio = 3
+mark = 0x1
+matchAddressExact = false
+onUnhealthy = ["/usr/local/bin/withdraw", "10.8.0.0/24"]
+
+[[interfaces.checks]]
+name = "web"
+type = "http"
+host = "example.com"
+retries = 2
+maxlosspcnt = 12.5
+headers."X-Api-Key" = "secret"
+responseCodes = [200, 204, "300-399"]
+
+[[interfaces]]
+name = "wg1"
+address = "10.9.0.2/24"
+ratio = 7
+`,
+}
+
+func TestUnmarshalConfigFormats(t *testing.T) {
+	var want *vpsInstance
+	for _, file := range []string{"config.yaml", "config.json", "config.toml"} {
+		got := new(vpsInstance)
+		if err := unmarshalConfig(file, []byte(formatConfigs[file]), got); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if want == nil {
+			want = got
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s decoded differently from config.yaml\ngot  %+v\nwant %+v", file, got, want)
+		}
+	}
+
+	// Spot check the YAML decode the others are compared to
+	if want.Interval != "30s" || want.LBTable.Name != "vpw" || len(want.Interfaces) != 2 {
+		t.Fatalf("config.yaml decoded as %+v", want)
+	}
+	wg0 := want.Interfaces[0]
+	if wg0.MatchAddressExact == nil || *wg0.MatchAddressExact || wg0.Mark != 1 {
+		t.Errorf("wg0 decoded as %+v", wg0)
+	}
+	if len(wg0.Checks) != 1 || wg0.Checks[0].Headers["X-Api-Key"] != "secret" || wg0.Checks[0].MaxLossPcnt != 12.5 {
+		t.Errorf("wg0 checks decoded as %+v", wg0.Checks)
+	}
+	if codes := wg0.Checks[0].ResponseCodes; !reflect.DeepEqual(codes, responseCodes{"200", "204", "300-399"}) {
+		t.Errorf("wg0 responseCodes decoded as %q", codes)
+	}
+}
+
+func TestUnmarshalResponseCodes(t *testing.T) {
+	for file, conf := range map[string]string{
+		"config.json": `{"interfaces": [{"name": "wg0", "checks": [{"name": "web", "responseCodes": [200, 204]}]}]}`,
+		"config.yaml": "interfaces:\n  - name: wg0\n    checks:\n      - name: web\n        responseCodes: [200, 204]\n",
+		"config.toml": "[[interfaces]]\nname = \"wg0\"\n\n[[interfaces.checks]]\nname = \"web\"\nresponseCodes = [200, 204]\n",
+	} {
+		got := new(vpsInstance)
+		if err := unmarshalConfig(file, []byte(conf), got); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		codes, err := parseResponseCodes(0, got.Interfaces[0].Checks[0].ResponseCodes)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if want := []codeRange{{200, 200}, {204, 204}}; !reflect.DeepEqual(codes, want) {
+			t.Errorf("%s: responseCodes [200, 204] parsed as %v, want %v", file, codes, want)
+		}
+	}
+
+	// Anything but numbers and strings is rejected while decoding
+	for file, conf := range map[string]string{
+		"config.json": `{"interfaces": [{"name": "wg0", "checks": [{"name": "web", "responseCodes": [true]}]}]}`,
+		"config.toml": "[[interfaces]]\nname = \"wg0\"\n\n[[interfaces.checks]]\nname = \"web\"\nresponseCodes = [2.5]\n",
+	} {
+		if err := unmarshalConfig(file, []byte(conf), new(vpsInstance)); err == nil {
+			t.Errorf("%s: bad response code accepted", file)
+		}
+	}
+}
+
+func TestMergeConfigReplacesLists(t *testing.T) {
+	dst := &vpsInstance{
+		HashKey: []string{"saddr", "etherSaddr"},
+		Interfaces: []*vpsInterface{{
+			Name:        "wg0",
+			Addresses:   []string{"10.8.0.2/24"},
+			OnUnhealthy: []string{"/bin/old", "a"},
+		}},
+	}
+	src := &vpsInstance{
+		HashKey: []string{"saddr"},
+		Interfaces: []*vpsInterface{{
+			Name:        "wg0",
+			Addresses:   []string{"fd00::2/64"},
+			OnUnhealthy: []string{"/bin/new"},
+		}},
+	}
+	if err := mergeConfig(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dst.HashKey, []string{"saddr"}) {
+		t.Errorf("hashKey merged to %v, want [saddr]", dst.HashKey)
+	}
+	wg0 := dst.Interfaces[0]
+	if !reflect.DeepEqual(wg0.OnUnhealthy, []string{"/bin/new"}) {
+		t.Errorf("onUnhealthy merged to %v, want [/bin/new]", wg0.OnUnhealthy)
+	}
+	if len(wg0.Addresses) != 2 {
+		t.Errorf("addresses merged to %v, want both", wg0.Addresses)
+	}
+}
+
+func TestUnmarshalConfigTOMLErrorLine(t *testing.T) {
+	conf := "interval = \"30s\"\n\n[[interfaces]]\nname = wg0\n"
+	err := unmarshalConfig("config.toml", []byte(conf), new(vpsInstance))
+	if err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Errorf("bad TOML value on line 4 reported as %v", err)
+	}
+}
@@ -4,103 +4,312 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"os/exec"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
 
-var (
-	nft           *nftables.Conn
-	lbTable       *nftables.Table
-	lbChain       *nftables.Chain
-	lbSet         *nftables.Set
-	lbSetElements []nftables.SetElement
-)
+var nft *nftables.Conn
+
+// Options for each NFTables connection, tests dial a fake netlink
+var nftOptions []nftables.ConnOption
+
+// A vmap rule balancing across some or all interfaces. Each is
+// reconfigured independently from the shared interface health
+type loadBalancer struct {
+	Name          string // For logs, defaults to Chain
+	Table         lbTableConfig
+	Chain         string
+	ChainType     string   `yaml:"chainType" toml:"chainType"`         // As lbChainType
+	ChainHook     string   `yaml:"chainHook" toml:"chainHook"`         // As lbChainHook
+	ChainPriority string   `yaml:"chainPriority" toml:"chainPriority"` // As lbChainPriority
+	HashKey       []string `yaml:"hashKey" toml:"hashKey"`             // As hashKey, defaults to it
+	Mode          string   `yaml:"mode" toml:"mode"`                   // As lbMode, defaults to it
+	Interfaces    []string // Names of interfaces to balance across, defaults to all
+	table         *nftables.Table
+	chain         *nftables.Chain
+	nifs          []*vpsInterface
+	status        string // Applied status, "all", "fallback" or "nif|nif..." of nifs
+}
+
+// Range of hash results sent to an interface target
+type lbBucket struct {
+	start uint32
+	end   uint32
+	nif   *vpsInterface
+}
 
-func initNFT() {
+// Connects to NFTables and prepares each load balancer, returning
+// why it couldn't so a reload can keep the running config
+func initNFT() error {
 	// Connect to NFT
-	nft = &nftables.Conn{}
+	conn, err := connectNFT()
+	if err != nil {
+		return fmt.Errorf("failed to connect to NFTables: %w", err)
+	}
+	nft = conn
+
+	// Target chains shared by load balancers in the same table
+	// are only prepared once
+	prepared := make(map[string]bool)
+	for _, lb := range config.LoadBalancers {
+		if err := lb.init(prepared); err != nil {
+			return err
+		}
+	}
+
+	// Derive status on startup from the live vmap. Several load
+	// balancers don't add up to one status, so use the state file
+	if currentStatus == "" {
+		if len(config.LoadBalancers) == 1 {
+			currentStatus = config.LoadBalancers[0].status
+		} else if currentStatus = loadState(); currentStatus != "" {
+			log.WithField("status", currentStatus).Info("Restored status from state file")
+		}
+	}
+	return nil
+}
 
+// Declares the table and chain, reads back the applied status
+// and ensures the chains exist
+func (lb *loadBalancer) init(prepared map[string]bool) error {
 	// Set Table Family
-	var family nftables.TableFamily
-	switch config.LBTable.Family {
-	case "ip":
-		family = nftables.TableFamilyIPv4
-	case "ip6":
-		family = nftables.TableFamilyIPv6
-	case "inet":
-		family = nftables.TableFamilyINet
-	default:
-		log.Fatalf("Unsupported LB Table Family %s", config.LBTable.Family)
+	family, err := tableFamily(lb.Table.Family)
+	if err != nil {
+		return fmt.Errorf("load balancer %s: %w", lb.Name, err)
 	}
 
 	// Declare Table
-	lbTable = &nftables.Table{
-		Name:   config.LBTable.Name,
+	lb.table = &nftables.Table{
+		Name:   lb.Table.Name,
 		Family: family,
 	}
 
-	// Declare Chain
-	lbChain = &nftables.Chain{
-		Name:  config.LBChain,
-		Table: lbTable,
+	// Declare Chain, a base chain if a hook is configured
+	lb.chain = &nftables.Chain{
+		Name:  lb.Chain,
+		Table: lb.table,
 	}
+	lb.chain.Type, lb.chain.Hooknum, lb.chain.Priority, _ = chainBase(
+		lb.ChainType, lb.ChainHook, lb.ChainPriority)
 
 	// Get Current Rules
-	rules, err := nft.GetRules(lbTable, lbChain)
+	fields := logrus.Fields{
+		"lb":    lb.Name,
+		"table": lb.Table.Name,
+		"chain": lb.Chain,
+	}
+	rules, err := nft.GetRules(lb.table, lb.chain)
 	if err != nil {
-		log.WithFields(logrus.Fields{
-			"table": config.LBTable.Name,
-			"chain": config.LBChain,
-			"error": err,
-		}).Error("Failed to retrieve NFT Rules")
+		log.WithFields(fields).WithField("error", err).Error("Failed to retrieve NFT Rules")
 	} else {
-		log.Debugf("NFT Rules Found: %d", len(rules))
+		log.Debugf("NFT Rules Found in %s: %d", lb.Name, len(rules))
 		for _, r := range rules {
 			logRule(r)
 		}
+
+		// Derive status from the live vmap, falling back to
+		// the state file if the vmap can't be read
+		if len(rules) > 0 {
+			status, err := lb.liveStatus(rules)
+			if err != nil {
+				log.WithFields(fields).WithField("error", err).Warn("Failed to read live NFTables status")
+				if len(config.LoadBalancers) == 1 {
+					status = loadState()
+					if status != "" {
+						log.WithField("status", status).Info("Restored status from state file")
+					}
+				}
+			} else if status != "" {
+				log.WithFields(fields).WithField("status", status).Info("Detected live NFTables status")
+			} else {
+				log.WithFields(fields).Warn("Unrecognized rules in LB chain, will reconfigure")
+			}
+			lb.status = status
+		}
 	}
 
 	// Ensure table and chain exist
-	addTable()
-	addChain()
+	if err := lb.addTable(); err != nil {
+		log.Errorf("Failed to create table %s: %+v", lb.table.Name, err)
+	}
+	if err := lb.addChain(); err != nil {
+		log.Errorf("Failed to create chain %s: %+v", lb.chain.Name, err)
+	}
 
 	// Prepare interface targets
-	for _, i := range config.Interfaces {
-		makeTarget(i)
+	for _, i := range lb.nifs {
+		key := lb.Table.Family + " " + lb.Table.Name + " " + i.Target
+		if prepared[key] || i.Verdict == "accept" || lb.Mode == "mark" {
+			continue
+		}
+		prepared[key] = true
+		if err := lb.makeTarget(i); err != nil {
+			log.Errorf("Failed to prepare target %s for %s: %+v", i.Target, i.Name, err)
+		}
 	}
+
+	// Fallback target must exist to be jumped to, its rules are
+	// left to the operator
+	if config.AllDownPolicy == "fallback" && !config.DryRun {
+		nft.AddChain(&nftables.Chain{
+			Name:  config.FallbackTarget,
+			Table: lb.table,
+		})
+		if err := commitAll(); err != nil {
+			log.Errorf("Failed to create fallback target %s: %+v", config.FallbackTarget, err)
+		}
+	}
+	return nil
 }
 
-func updateNFT(ds string) string {
-	// Connect to NFTables
-	var err error
-	nft, err = connectNFT()
-	if err != nil {
-		log.Errorf("Failed to connect to NFTables: %+v", err)
-		return ""
+// Parses an LB table family
+func tableFamily(family string) (nftables.TableFamily, error) {
+	switch family {
+	case "ip":
+		return nftables.TableFamilyIPv4, nil
+	case "ip6":
+		return nftables.TableFamilyIPv6, nil
+	case "inet":
+		return nftables.TableFamilyINet, nil
 	}
+	return 0, fmt.Errorf("unsupported LB Table Family %s", family)
+}
 
-	// Set Rules
-	var state string
-	if ds == "all" {
-		log.Debugf("Setting NFTables LB Rule to all")
-		routeToAll()
+// Routes each load balancer to its share of the desired status
+// ("all", "fallback" or "nif|nif..."), skipping those already there.
+// Errors leave that load balancer as it was, the caller keeps its
+// current status so the next check retries
+func updateNFT(ds string) error {
+	// Connect to NFTables
+	if config.DryRun {
+		log.Infof("Dry run, not connecting to NFTables")
 	} else {
-		log.Infof("Asked to route to interface(s) %s", ds)
-		routeToSubset(ds)
+		var err error
+		nft, err = connectNFT()
+		if err != nil {
+			return fmt.Errorf("failed to connect to NFTables: %w", err)
+		}
+	}
+
+	var errs []string
+	for _, lb := range config.LoadBalancers {
+		want := lb.want(ds)
+		if want == "" || want == lb.status {
+			continue
+		}
+		if err := lb.route(want); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", lb.Name, err))
+			continue
+		}
+		lb.status = want
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// True if every load balancer already routes its share of ds
+func lbsSynced(ds string) bool {
+	for _, lb := range config.LoadBalancers {
+		if want := lb.want(ds); want != "" && want != lb.status {
+			return false
+		}
+	}
+	return true
+}
+
+// Narrows the shared desired status to this load balancer's
+// interfaces. With none of them healthy allDownPolicy applies,
+// keep returns the applied status
+func (lb *loadBalancer) want(ds string) string {
+	if ds == "" || ds == "all" || ds == "fallback" {
+		if ds == "" {
+			return lb.status
+		}
+		return ds
+	}
+	healthy := strings.Split(ds, "|")
+	var ss []string
+	for _, i := range lb.nifs {
+		if contains(healthy, i.Name) {
+			ss = append(ss, i.Name)
+		}
+	}
+	switch {
+	case len(ss) == len(lb.nifs):
+		return "all"
+	case len(ss) > 0:
+		return strings.Join(ss, "|")
+	}
+	switch config.AllDownPolicy {
+	case "all", "fallback":
+		return config.AllDownPolicy
+	}
+	return lb.status
+}
+
+// Applies cleanupOnExit once checks have stopped. Rules are left
+// in place by default so routing survives the watcher
+func cleanupNFT() {
+	switch config.CleanupOnExit {
+	case "flush":
+		log.Warn("Flushing load balancer chains before exit")
+		if !config.DryRun {
+			conn, err := connectNFT()
+			if err != nil {
+				log.Errorf("Failed to connect to NFTables for cleanup: %+v", err)
+				return
+			}
+			nft = conn
+		}
+		for _, lb := range config.LoadBalancers {
+			lb.flushChainRules()
+			lb.status = ""
+		}
+	case "all":
+		log.Warn("Routing to all interfaces before exit")
+		if err := updateNFT("all"); err != nil {
+			log.Errorf("Failed to route to all interfaces before exit: %+v", err)
+			return
+		}
+		saveState("all")
+	}
+}
+
+// Sets the rules for one of this load balancer's statuses
+func (lb *loadBalancer) route(status string) error {
+	if status == "all" {
+		log.WithField("lb", lb.Name).Debugf("Setting NFTables LB Rule to all")
+		return lb.routeToAll()
+	}
+	if status == "fallback" {
+		log.WithFields(logrus.Fields{
+			"lb":             lb.Name,
+			"fallbackTarget": config.FallbackTarget,
+		}).Warn("Routing everything to fallback target")
+		return lb.routeToFallback()
 	}
-	state = ds
-	return state
+	log.WithFields(logrus.Fields{
+		"lb":     lb.Name,
+		"status": status,
+	}).Info("Asked to route to interface(s)")
+	return lb.routeToSubset(status)
 }
 
 func connectNFT() (*nftables.Conn, error) {
-	conn, err := nftables.New()
+	conn, err := nftables.New(nftOptions...)
 	if err != nil {
 		return nil, err
 	}
@@ -108,94 +317,521 @@ func connectNFT() (*nftables.Conn, error) {
 }
 
 // Routes to only specific interfaces
-func routeToSubset(ss string) {
+func (lb *loadBalancer) routeToSubset(ss string) error {
 	nifs := strings.Split(ss, "|")
 	if len(nifs) < 1 {
-		log.Error("Not enough interfaces provided, doing nothing")
-		return
+		return errors.New("not enough interfaces provided")
 	}
 	var ssNIFs []*vpsInterface
 	for _, n := range nifs {
-		for _, i := range config.Interfaces {
+		for _, i := range lb.nifs {
 			if n == i.Name {
 				ssNIFs = append(ssNIFs, i)
 			}
 		}
 	}
 	if len(ssNIFs) < 1 {
-		log.Fatalf("Couldn't find matching interfaces for %s", nifs)
-		return
+		return fmt.Errorf("couldn't find matching interfaces for %s", nifs)
 	}
-	// Create New Rule
-	flushChainRules()
-	addRuleToChain(ssNIFs)
+	// Replace Rule
+	return lb.addRuleToChain(ssNIFs)
 }
 
 // Creates a vmap based round-robin load balancer
 // using ratios provided in interfaces[].ratio
-func routeToAll() {
-	flushChainRules()
-	addRuleToChain(config.Interfaces)
+func (lb *loadBalancer) routeToAll() error {
+	return lb.addRuleToChain(lb.nifs)
+}
+
+// Replaces the chain rules with a single goto config.FallbackTarget,
+// in one transaction like addRuleToChain
+func (lb *loadBalancer) routeToFallback() error {
+	if config.DryRun {
+		log.Infof("Dry run, would replace chain %s rules with goto %s", lb.chain.Name, config.FallbackTarget)
+		return nil
+	}
+	nft.FlushChain(lb.chain)
+	nft.AddRule(&nftables.Rule{
+		Table: lb.table,
+		Chain: lb.chain,
+		Exprs: []expr.Any{
+			&expr.Verdict{
+				Kind:  expr.VerdictGoto,
+				Chain: config.FallbackTarget,
+			},
+		},
+	})
+	if err := nft.Flush(); err != nil {
+		return fmt.Errorf("failed to create fallback rule in %s %s: %w",
+			lb.table.Name, lb.chain.Name, err)
+	}
+	return nil
 }
 
-// Add rule to all configured interfaces
-func addRuleToChain(i []*vpsInterface) {
+// Replaces the chain rules with one balancing across the given
+// interfaces. The flush and add are committed in one transaction
+// so traffic never sees an empty chain.
+func (lb *loadBalancer) addRuleToChain(i []*vpsInterface) error {
+	if len(i) == 0 {
+		return errors.New("no interfaces to balance across")
+	}
+
 	// Create the rule
-	ruleStr := makeRule(i)
-	log.Debugf("Loading Rule %s", ruleStr)
-	// Load the rule
-	nftProg, err := exec.LookPath("nft")
-	if err != nil {
-		log.Fatalf("Failed to locate nft binary: %s", err)
+	mod, buckets := makeBuckets(i)
+	rule := ruleString(lb.Table.Family, lb.Table.Name, lb.Chain, lb.HashKey, lb.Mode, i)
+	log.Debugf("Hash modulus %d across %d interfaces", mod, len(buckets))
+	if config.DryRun {
+		log.Infof("Dry run, would replace chain %s rules with %s", lb.chain.Name, rule)
+		return nil
+	}
+	log.Debugf("Loading Rule %s", rule)
+
+	// Anonymous verdict map of hash buckets to interface targets,
+	// or in mark mode a map to interface marks
+	mark := lb.Mode == "mark"
+	vmap := &nftables.Set{
+		Table:     lb.table,
+		Anonymous: true,
+		Constant:  true,
+		IsMap:     true,
+		Interval:  true,
+		KeyType:   nftables.TypeInteger,
+		DataType:  nftables.TypeVerdict,
+	}
+	if mark {
+		vmap.DataType = nftables.TypeMark
+	}
+	if err := nft.AddSet(vmap, makeVmapElements(mod, buckets, mark)); err != nil {
+		return fmt.Errorf("failed to prepare load-balancing vmap: %w", err)
+	}
+
+	// Swap the rule
+	nft.FlushChain(lb.chain)
+	nft.AddRule(&nftables.Rule{
+		Table: lb.table,
+		Chain: lb.chain,
+		Exprs: makeRule(lb.table.Family, lb.HashKey, mod, vmap, mark),
+	})
+	if err := nft.Flush(); err != nil {
+		return fmt.Errorf("failed to create load-balancing rule in %s %s: %w",
+			lb.table.Name, lb.chain.Name, err)
+	}
+	return nil
+}
+
+// Divides the hash modulus into vmap buckets given a list of interfaces
+// using ratios provided in interfaces[].ratio. The modulus is the sum
+// of all ratios, so each interface gets ratio/sum of traffic.
+func makeBuckets(i []*vpsInterface) (uint32, []lbBucket) {
+	var mod uint32
+	var buckets []lbBucket
+	for _, nif := range i {
+		buckets = append(buckets, lbBucket{
+			start: mod,
+			end:   mod + uint32(nif.Ratio) - 1,
+			nif:   nif,
+		})
+		mod += uint32(nif.Ratio)
+	}
+	return mod, buckets
+}
+
+// A field of the jhash key, loaded into register reg
+type hashField struct {
+	nft  string // nft syntax for ruleString
+	len  uint32 // Bytes loaded, each field is padded to 32 bit registers
+	load func(reg uint32) expr.Any
+}
+
+// Fields hashKey may hash on, the default keeps flows from a client
+// spread across interfaces while saddr alone keeps them sticky
+var (
+	hashFields = map[string]hashField{
+		"saddr": {"ip saddr", 4, func(reg uint32) expr.Any {
+			return &expr.Payload{DestRegister: reg, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4}
+		}},
+		"daddr": {"ip daddr", 4, func(reg uint32) expr.Any {
+			return &expr.Payload{DestRegister: reg, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4}
+		}},
+		"etherSaddr": {"ether saddr", 6, func(reg uint32) expr.Any {
+			return &expr.Payload{DestRegister: reg, Base: expr.PayloadBaseLLHeader, Offset: 6, Len: 6}
+		}},
+		"l4proto": {"meta l4proto", 1, func(reg uint32) expr.Any {
+			return &expr.Meta{Key: expr.MetaKeyL4PROTO, Register: reg}
+		}},
+		"sport": {"th sport", 2, func(reg uint32) expr.Any {
+			return &expr.Payload{DestRegister: reg, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 2}
+		}},
+		"dport": {"th dport", 2, func(reg uint32) expr.Any {
+			return &expr.Payload{DestRegister: reg, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2}
+		}},
+	}
+	// ip6 tables hash the IPv6 header addresses instead
+	hashFields6 = map[string]hashField{
+		"saddr": {"ip6 saddr", 16, func(reg uint32) expr.Any {
+			return &expr.Payload{DestRegister: reg, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 16}
+		}},
+		"daddr": {"ip6 daddr", 16, func(reg uint32) expr.Any {
+			return &expr.Payload{DestRegister: reg, Base: expr.PayloadBaseNetworkHeader, Offset: 24, Len: 16}
+		}},
+	}
+	defHashKey = []string{"saddr", "etherSaddr", "l4proto", "sport"}
+)
+
+// The hashKey field k for an ip6 table or any other family
+func hashFieldOf(k string, ip6 bool) hashField {
+	if f, found := hashFields6[k]; found && ip6 {
+		return f
 	}
-	nftCmd := exec.Command(nftProg, ruleStr)
-	log.Tracef("Running %s", nftCmd.String())
-	if out, err := nftCmd.Output(); err != nil {
-		log.Fatalf("Failed to create load-balancing rule: %s", out, string(err.(*exec.ExitError).Stderr))
+	return hashFields[k]
+}
+
+// Bytes of registers a hash key occupies
+func hashKeyLen(hashKey []string, ip6 bool) uint32 {
+	var length uint32
+	for _, k := range hashKey {
+		length += (hashFieldOf(k, ip6).len + 3) / 4 * 4
+	}
+	return length
+}
+
+// Renders a hash key in nft syntax, e.g. ip saddr . th sport
+func hashKeyString(hashKey []string, ip6 bool) string {
+	var ss []string
+	for _, k := range hashKey {
+		ss = append(ss, hashFieldOf(k, ip6).nft)
 	}
+	return strings.Join(ss, " . ")
 }
 
-// Generates a load-balancing rule given a list of interfaces
-func makeRule(i []*vpsInterface) string {
-	// Make sure we're not going to send packets to nowhere
-	var mod uint8 = 10
-	var ttlMod uint8
-	for _, i := range i {
-		ttlMod += uint8(i.Ratio)
+// Generates the native load-balancing rule expressions, equivalent to
+// jhash <hashKey> mod <mod> vmap <vmap>, or with mark
+// meta mark set jhash <hashKey> mod <mod> map <vmap>
+func makeRule(family nftables.TableFamily, hashKey []string, mod uint32, vmap *nftables.Set, mark bool) []expr.Any {
+	var exprs []expr.Any
+
+	// ip addresses in an inet table depend on ipv4
+	if family == nftables.TableFamilyINet && (contains(hashKey, "saddr") || contains(hashKey, "daddr")) {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+		)
+	}
+
+	// ether saddr depends on an ethernet input interface
+	if contains(hashKey, "etherSaddr") {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyIIFTYPE, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint16(unix.ARPHRD_ETHER)},
+		)
+	}
+
+	// Concatenate the hash key, each field padded to 32 bit registers
+	ip6 := family == nftables.TableFamilyIPv6
+	var length uint32
+	for _, k := range hashKey {
+		reg := uint32(1)
+		if length > 0 {
+			reg = unix.NFT_REG32_00 + length/4
+		}
+		exprs = append(exprs, hashFieldOf(k, ip6).load(reg))
+		length += hashKeyLen([]string{k}, ip6)
+	}
+
+	// Hash into buckets and look up the verdict, interval
+	// maps are keyed in network byte order
+	lookup := &expr.Lookup{
+		SourceRegister: 1,
+		DestRegister:   0,
+		IsDestRegSet:   true,
+		SetID:          vmap.ID,
+		SetName:        vmap.Name,
+	}
+	if mark {
+		lookup.DestRegister = 1
 	}
-	if ttlMod != 10 {
-		log.Debugf("Adjusting modulus, %d != 10", ttlMod)
-		mod = ttlMod
+	exprs = append(exprs,
+		&expr.Hash{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Length:         length,
+			Modulus:        mod,
+			Type:           expr.HashTypeJenkins,
+		},
+		&expr.Byteorder{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Op:             expr.ByteorderHton,
+			Len:            4,
+			Size:           4,
+		},
+		lookup,
+	)
+
+	// Marked packets carry on through the ruleset for ip rules to route
+	if mark {
+		exprs = append(exprs, &expr.Meta{
+			Key:            expr.MetaKeyMARK,
+			SourceRegister: true,
+			Register:       1,
+		})
+	}
+	return exprs
+}
+
+// Generates vmap interval elements, each bucket start jumps to the
+// interface target, or with mark carries its mark, and the last
+// bucket is closed at the modulus
+func makeVmapElements(mod uint32, buckets []lbBucket, mark bool) []nftables.SetElement {
+	var elements []nftables.SetElement
+	for _, b := range buckets {
+		e := nftables.SetElement{Key: binaryutil.BigEndian.PutUint32(b.start)}
+		if mark {
+			e.Val = binaryutil.NativeEndian.PutUint32(uint32(b.nif.Mark))
+		} else {
+			e.VerdictData = b.nif.verdict()
+		}
+		elements = append(elements, e)
 	}
+	elements = append(elements, nftables.SetElement{
+		Key:         binaryutil.BigEndian.PutUint32(mod),
+		IntervalEnd: true,
+	})
+	return elements
+}
 
-	// Prepare the rule
+// Renders the load-balancing rule across the given interfaces in nft
+// syntax, as addRuleToChain loads it. Single value buckets are written
+// alone since nft rejects zero size ranges, and no interfaces renders
+// empty as there is nothing to hash into
+func ruleString(family, table, chain string, hashKey []string, mode string, nifs []*vpsInterface) string {
+	if len(nifs) == 0 {
+		return ""
+	}
+	mod, buckets := makeBuckets(nifs)
 	var rule bytes.Buffer
-	rule.WriteString(fmt.Sprintf("add rule %s %s %s ", config.LBTable.Family, config.LBTable.Name, config.LBChain))
-	rule.WriteString(fmt.Sprintf("jhash ip saddr . ether saddr . meta l4proto . th sport mod %d vmap {", mod))
-	var curMod uint8
-	for _, nif := range i {
-		rule.WriteString(fmt.Sprintf(" %d-%d : goto %s,", curMod, uint8(nif.Ratio)+(curMod-1), nif.Target))
-		curMod += uint8(nif.Ratio)
+	rule.WriteString(fmt.Sprintf("add rule %s %s %s ", family, table, chain))
+	key := hashKeyString(hashKey, family == "ip6")
+	if mode == "mark" {
+		rule.WriteString(fmt.Sprintf("meta mark set jhash %s mod %d map {", key, mod))
+	} else {
+		rule.WriteString(fmt.Sprintf("jhash %s mod %d vmap {", key, mod))
 	}
-	rule.Truncate(rule.Len() - 1)
-	rule.WriteRune(' ')
-	rule.WriteRune('}')
+	for n, b := range buckets {
+		if n > 0 {
+			rule.WriteRune(',')
+		}
+		data := b.nif.verdictString()
+		if mode == "mark" {
+			data = fmt.Sprintf("%#x", b.nif.Mark)
+		}
+		if b.start == b.end {
+			rule.WriteString(fmt.Sprintf(" %d : %s", b.start, data))
+		} else {
+			rule.WriteString(fmt.Sprintf(" %d-%d : %s", b.start, b.end, data))
+		}
+	}
+	rule.WriteString(" }")
 	return rule.String()
 }
 
+// Reconstructs the routed status from the chain's vmap by matching
+// its goto verdicts to interface targets, or in mark mode its marks
+// to interface marks. Returns empty if the rules don't look like
+// ones addRuleToChain wrote
+func (lb *loadBalancer) liveStatus(rules []*nftables.Rule) (string, error) {
+	if len(rules) != 1 {
+		return "", nil
+	}
+	var setName string
+	for _, e := range rules[0].Exprs {
+		if l, ok := e.(*expr.Lookup); ok {
+			// A changed lbMode needs the rule rewritten, verdicts
+			// are looked up into register 0 and marks aren't
+			if (l.DestRegister != 0) != (lb.Mode == "mark") {
+				return "", nil
+			}
+			setName = l.SetName
+		}
+		// A changed hashKey needs the rule rewritten
+		if h, ok := e.(*expr.Hash); ok && h.Length != hashKeyLen(lb.HashKey, lb.table.Family == nftables.TableFamilyIPv6) {
+			return "", nil
+		}
+		if v, ok := e.(*expr.Verdict); ok && v.Kind == expr.VerdictGoto &&
+			config.AllDownPolicy == "fallback" && v.Chain == config.FallbackTarget {
+			return "fallback", nil
+		}
+	}
+	if setName == "" {
+		return "", nil
+	}
+	set, err := nft.GetSetByName(lb.table, setName)
+	if err != nil {
+		return "", fmt.Errorf("failed to get vmap %s: %w", setName, err)
+	}
+	elements, err := nft.GetSetElements(set)
+	if err != nil {
+		return "", fmt.Errorf("failed to get vmap %s elements: %w", setName, err)
+	}
+	if lb.Mode == "mark" {
+		return lb.markStatus(elements), nil
+	}
+
+	// Chains currently routed to, by verdict. Verdicts without
+	// a chain can't be told apart, so those are reconfigured
+	routed := make(map[string]expr.VerdictKind)
+	for _, e := range elements {
+		if e.IntervalEnd {
+			continue
+		}
+		kind, chain := verdictChain(e.Val)
+		if chain == "" {
+			return "", nil
+		}
+		routed[chain] = kind
+	}
+
+	var ss []string
+	known := make(map[string]bool)
+	for _, i := range lb.nifs {
+		known[i.Target] = true
+		if kind, found := routed[i.Target]; found {
+			if kind != i.verdict().Kind {
+				return "", nil
+			}
+			ss = append(ss, i.Name)
+		}
+	}
+	for chain := range routed {
+		if !known[chain] {
+			log.WithField("chain", chain).Debug("Live vmap routes to an unknown chain")
+			return "", nil
+		}
+	}
+	if len(ss) == 0 {
+		return "", nil
+	}
+	if len(ss) == len(lb.nifs) {
+		return "all", nil
+	}
+	return strings.Join(ss, "|"), nil
+}
+
+// Status from the marks of a mark mode map, empty on marks
+// not belonging to one of the interfaces
+func (lb *loadBalancer) markStatus(elements []nftables.SetElement) string {
+	routed := make(map[uint32]bool)
+	for _, e := range elements {
+		if e.IntervalEnd {
+			continue
+		}
+		if len(e.Val) != 4 {
+			return ""
+		}
+		routed[binaryutil.NativeEndian.Uint32(e.Val)] = true
+	}
+
+	var ss []string
+	known := make(map[uint32]bool)
+	for _, i := range lb.nifs {
+		known[uint32(i.Mark)] = true
+		if routed[uint32(i.Mark)] {
+			ss = append(ss, i.Name)
+		}
+	}
+	for mark := range routed {
+		if !known[mark] {
+			log.WithField("mark", fmt.Sprintf("%#x", mark)).Debug("Live map sets an unknown mark")
+			return ""
+		}
+	}
+	if len(ss) == 0 {
+		return ""
+	}
+	if len(ss) == len(lb.nifs) {
+		return "all"
+	}
+	return strings.Join(ss, "|")
+}
+
+// Decodes a vmap element's verdict data, returning the
+// kind and chain for goto or jump verdicts, empty otherwise
+func verdictChain(data []byte) (expr.VerdictKind, string) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return 0, ""
+	}
+	ad.ByteOrder = binary.BigEndian
+	var kind expr.VerdictKind
+	var chain string
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_VERDICT_CODE:
+			kind = expr.VerdictKind(int32(ad.Uint32()))
+		case unix.NFTA_VERDICT_CHAIN:
+			chain = ad.String()
+		}
+	}
+	if ad.Err() != nil || (kind != expr.VerdictGoto && kind != expr.VerdictJump) {
+		return 0, ""
+	}
+	return kind, chain
+}
+
+// Verdicts an interface's vmap entry may use
+var verdictKinds = map[string]expr.VerdictKind{
+	"goto":   expr.VerdictGoto,
+	"jump":   expr.VerdictJump,
+	"accept": expr.VerdictAccept,
+}
+
+// The interface's vmap verdict, goto or jump to Target or accept
+func (i *vpsInterface) verdict() *expr.Verdict {
+	kind := verdictKinds[i.Verdict]
+	if kind == expr.VerdictAccept {
+		return &expr.Verdict{Kind: kind}
+	}
+	return &expr.Verdict{Kind: kind, Chain: i.Target}
+}
+
+// The interface's vmap verdict in nft syntax
+func (i *vpsInterface) verdictString() string {
+	if i.Verdict == "accept" {
+		return i.Verdict
+	}
+	return i.Verdict + " " + i.Target
+}
+
 // Sets up target chains for interface
-func makeTarget(i *vpsInterface) {
+func (lb *loadBalancer) makeTarget(i *vpsInterface) error {
+	if config.DryRun {
+		log.Infof("Dry run, would create target chain %s with mark %#x", i.Target, i.Mark)
+		return nil
+	}
 	chain := &nftables.Chain{
 		Name:  i.Target,
-		Table: lbTable,
+		Table: lb.table,
 	}
 	nft.AddChain(chain)
-	commitAll()
+	if err := commitAll(); err != nil {
+		return err
+	}
 	// If a mark is declared, manage the rule here
 	if i.Mark != 0x0 {
+		// Leave a matching rule alone, flushing would
+		// leave packets unmarked until the rule is back
+		if rules, err := nft.GetRules(lb.table, chain); err != nil {
+			log.Warnf("Failed to read mark rule from %s, replacing it: %+v", chain.Name, err)
+		} else if len(rules) == 1 && markRuleCurrent(rules[0], i.Mark, i.Counter) {
+			log.Debugf("Mark rule %#x in %s already current", i.Mark, chain.Name)
+			return nil
+		}
+
 		// Prepare chain and rule
 		nft.FlushChain(chain)
-		commitAll()
+		if err := commitAll(); err != nil {
+			return err
+		}
 
 		// Prepare nftables.expr rule
 		//// Build rule epressions
@@ -221,17 +857,19 @@ func makeTarget(i *vpsInterface) {
 		})
 		//// Build rule
 		nftRule := &nftables.Rule{
-			Table: lbTable,
+			Table: lb.table,
 			Chain: chain,
 			Exprs: ruleExprs,
 		}
 
 		// Load the rule
 		nft.AddRule(nftRule)
-		commitAll()
+		if err := commitAll(); err != nil {
+			return err
+		}
 
 		// Trace debug our rule
-		rules, err := nft.GetRules(lbTable, chain)
+		rules, err := nft.GetRules(lb.table, chain)
 		if err != nil {
 			log.Errorf("Failed to retrieve new rule from %s: %+v", chain.Name, err)
 		} else if len(rules) > 0 {
@@ -239,32 +877,137 @@ func makeTarget(i *vpsInterface) {
 			logRule(rules[0])
 		}
 	}
+	return nil
+}
+
+// True if rule is exactly the mark rule makeTarget builds: set
+// the mark, count if asked, and return. Counter values are ignored
+func markRuleCurrent(rule *nftables.Rule, mark uint8, counter bool) bool {
+	exprs := rule.Exprs
+	want := 3
+	if counter {
+		want = 4
+	}
+	if len(exprs) != want {
+		return false
+	}
+	imm, ok := exprs[0].(*expr.Immediate)
+	if !ok || imm.Register != 1 || !bytes.Equal(imm.Data, []byte{mark, 0, 0, 0}) {
+		return false
+	}
+	meta, ok := exprs[1].(*expr.Meta)
+	if !ok || meta.Key != unix.NFT_META_MARK || !meta.SourceRegister || meta.Register != 1 {
+		return false
+	}
+	if counter {
+		if _, ok := exprs[2].(*expr.Counter); !ok {
+			return false
+		}
+	}
+	verdict, ok := exprs[want-1].(*expr.Verdict)
+	return ok && verdict.Kind == expr.VerdictReturn
 }
 
 // Delete all rules in chain
-func flushChainRules() {
-	nft.FlushChain(lbChain)
+func (lb *loadBalancer) flushChainRules() {
+	if config.DryRun {
+		log.Infof("Dry run, would flush chain %s", lb.chain.Name)
+		return
+	}
+	nft.FlushChain(lb.chain)
 	if err := nft.Flush(); err != nil {
 		log.WithFields(logrus.Fields{
-			"Table": lbChain.Table.Name,
-			"Chain": lbChain.Name,
+			"Table": lb.table.Name,
+			"Chain": lb.chain.Name,
 			"Error": err,
 		}).Error("Failed to flush chain rules")
 	}
 }
 
 // Add the table
-func addTable() {
-	nft.AddTable(lbTable)
-	log.Debugf("Creating Table: %+v", lbTable)
-	commitAll()
+func (lb *loadBalancer) addTable() error {
+	if config.DryRun {
+		log.Infof("Dry run, would create table %s", lb.table.Name)
+		return nil
+	}
+	nft.AddTable(lb.table)
+	log.Debugf("Creating Table: %+v", lb.table)
+	return commitAll()
+}
+
+// Named base chain priorities as nft accepts them
+var chainPriorities = map[string]nftables.ChainPriority{
+	"raw":      nftables.ChainPriorityRaw,
+	"mangle":   nftables.ChainPriorityMangle,
+	"dstnat":   nftables.ChainPriorityNATDest,
+	"filter":   nftables.ChainPriorityFilter,
+	"security": nftables.ChainPrioritySecurity,
+	"srcnat":   nftables.ChainPriorityNATSource,
+}
+
+// Parses base chain settings. An empty type leaves a regular chain,
+// otherwise hook is required and priority is a name or integer,
+// defaulting to filter
+func chainBase(typ, hook, priority string) (nftables.ChainType, nftables.ChainHook, nftables.ChainPriority, error) {
+	if typ == "" {
+		if hook != "" || priority != "" {
+			return "", 0, 0, errors.New("chain hook and priority need a chain type")
+		}
+		return "", 0, 0, nil
+	}
+
+	var chainType nftables.ChainType
+	switch typ {
+	case "filter":
+		chainType = nftables.ChainTypeFilter
+	case "route":
+		chainType = nftables.ChainTypeRoute
+	case "nat":
+		chainType = nftables.ChainTypeNAT
+	default:
+		return "", 0, 0, fmt.Errorf("unknown chain type %s, want filter, route or nat", typ)
+	}
+
+	var chainHook nftables.ChainHook
+	switch hook {
+	case "prerouting":
+		chainHook = nftables.ChainHookPrerouting
+	case "input":
+		chainHook = nftables.ChainHookInput
+	case "forward":
+		chainHook = nftables.ChainHookForward
+	case "output":
+		chainHook = nftables.ChainHookOutput
+	case "postrouting":
+		chainHook = nftables.ChainHookPostrouting
+	case "":
+		return "", 0, 0, fmt.Errorf("chain type %s needs a hook", typ)
+	default:
+		return "", 0, 0, fmt.Errorf("unknown chain hook %s, want prerouting, input, forward, output or postrouting", hook)
+	}
+
+	chainPriority := nftables.ChainPriorityFilter
+	if priority != "" {
+		if p, found := chainPriorities[priority]; found {
+			chainPriority = p
+		} else if n, err := strconv.ParseInt(priority, 10, 32); err == nil {
+			chainPriority = nftables.ChainPriority(n)
+		} else {
+			return "", 0, 0, fmt.Errorf("unknown chain priority %s, want a name like mangle or an integer", priority)
+		}
+	}
+	return chainType, chainHook, chainPriority, nil
 }
 
 // Add the chain
-func addChain() {
-	nft.AddChain(lbChain)
-	log.Debugf("Creating Chain: %+v", lbChain)
-	commitAll()
+func (lb *loadBalancer) addChain() error {
+	if config.DryRun {
+		log.Infof("Dry run, would create chain %s", lb.chain.Name)
+		return nil
+	}
+	nft.AddChain(lb.chain)
+	log.Debugf("Creating Chain: %+v", lb.chain)
+	return commitAll()
 }
 
 // Log rule and its expressions
@@ -290,8 +1033,9 @@ func getRuleExpressions(r *nftables.Rule) []string {
 }
 
 // Commit rules
-func commitAll() {
+func commitAll() error {
 	if err := nft.Flush(); err != nil {
-		log.Panicf("Error Flushing NFTables Config: %s", err)
+		return fmt.Errorf("error flushing NFTables config: %w", err)
 	}
+	return nil
 }
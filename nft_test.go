@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+	"golang.org/x/sys/unix"
+)
+
+// Interfaces jumping to their own target chain with the given ratios
+func testInterfaces(ratios ...int) []*vpsInterface {
+	var nifs []*vpsInterface
+	for n, r := range ratios {
+		name := string(rune('a' + n))
+		nifs = append(nifs, &vpsInterface{
+			Name:    name,
+			Ratio:   r,
+			Target:  name,
+			Verdict: "goto",
+			Mark:    uint8(n + 1),
+		})
+	}
+	return nifs
+}
+
+func TestRuleString(t *testing.T) {
+	key := []string{"saddr", "sport"}
+	tests := []struct {
+		name   string
+		family string
+		mode   string
+		nifs   []*vpsInterface
+		want   string
+	}{
+		{"none", "ip", "goto", nil, ""},
+		{"single all", "ip", "goto", testInterfaces(10),
+			"add rule ip t lb jhash ip saddr . th sport mod 10 vmap { 0-9 : goto a }"},
+		{"single ratio 1", "ip", "goto", testInterfaces(1),
+			"add rule ip t lb jhash ip saddr . th sport mod 1 vmap { 0 : goto a }"},
+		{"two summing to 10", "ip", "goto", testInterfaces(3, 7),
+			"add rule ip t lb jhash ip saddr . th sport mod 10 vmap { 0-2 : goto a, 3-9 : goto b }"},
+		{"two not summing to 10", "ip", "goto", testInterfaces(1, 2),
+			"add rule ip t lb jhash ip saddr . th sport mod 3 vmap { 0 : goto a, 1-2 : goto b }"},
+		{"three summing past 10", "inet", "goto", testInterfaces(5, 1, 20),
+			"add rule inet t lb jhash ip saddr . th sport mod 26 vmap { 0-4 : goto a, 5 : goto b, 6-25 : goto c }"},
+		{"three equal", "ip6", "goto", testInterfaces(1, 1, 1),
+			"add rule ip6 t lb jhash ip6 saddr . th sport mod 3 vmap { 0 : goto a, 1 : goto b, 2 : goto c }"},
+		{"three marked", "ip", "mark", testInterfaces(2, 3, 5),
+			"add rule ip t lb meta mark set jhash ip saddr . th sport mod 10 map { 0-1 : 0x1, 2-4 : 0x2, 5-9 : 0x3 }"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ruleString(tt.family, "t", "lb", key, tt.mode, tt.nifs)
+			if got != tt.want {
+				t.Errorf("got  %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleStringVerdicts(t *testing.T) {
+	nifs := testInterfaces(1, 1)
+	nifs[0].Verdict = "jump"
+	nifs[1].Verdict = "accept"
+	want := "add rule ip t lb jhash ip saddr mod 2 vmap { 0 : jump a, 1 : accept }"
+	if got := ruleString("ip", "t", "lb", []string{"saddr"}, "goto", nifs); got != want {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+}
+
+func TestMakeBuckets(t *testing.T) {
+	type bucket struct {
+		start, end uint32
+		name       string
+	}
+	tests := []struct {
+		ratios []int
+		mod    uint32
+		want   []bucket
+	}{
+		{[]int{3, 7}, 10, []bucket{{0, 2, "a"}, {3, 9, "b"}}},
+		{[]int{1, 255}, 256, []bucket{{0, 0, "a"}, {1, 255, "b"}}},
+		{[]int{4, 4, 2}, 10, []bucket{{0, 3, "a"}, {4, 7, "b"}, {8, 9, "c"}}},
+		{[]int{100, 1, 9}, 110, []bucket{{0, 99, "a"}, {100, 100, "b"}, {101, 109, "c"}}},
+	}
+	for _, tt := range tests {
+		mod, buckets := makeBuckets(testInterfaces(tt.ratios...))
+		if mod != tt.mod {
+			t.Errorf("ratios %v: mod %d, want %d", tt.ratios, mod, tt.mod)
+		}
+		if len(buckets) != len(tt.want) {
+			t.Fatalf("ratios %v: %d buckets, want %d", tt.ratios, len(buckets), len(tt.want))
+		}
+		for n, b := range buckets {
+			w := tt.want[n]
+			if b.start != w.start || b.end != w.end || b.nif.Name != w.name {
+				t.Errorf("ratios %v: bucket %d is %d-%d : %s, want %d-%d : %s",
+					tt.ratios, n, b.start, b.end, b.nif.Name, w.start, w.end, w.name)
+			}
+		}
+	}
+}
+
+func TestMakeVmapElements(t *testing.T) {
+	for _, ratios := range [][]int{{3, 7}, {2, 5, 6}} {
+		mod, buckets := makeBuckets(testInterfaces(ratios...))
+		elements := makeVmapElements(mod, buckets, false)
+		if len(elements) != len(buckets)+1 {
+			t.Fatalf("ratios %v: %d elements, want %d", ratios, len(elements), len(buckets)+1)
+		}
+		for n, b := range buckets {
+			e := elements[n]
+			if got := binaryutil.BigEndian.Uint32(e.Key); got != b.start || e.IntervalEnd {
+				t.Errorf("ratios %v: element %d starts at %d, want %d", ratios, n, got, b.start)
+			}
+			if e.VerdictData == nil || e.VerdictData.Kind != expr.VerdictGoto || e.VerdictData.Chain != b.nif.Target {
+				t.Errorf("ratios %v: element %d verdict %+v, want goto %s", ratios, n, e.VerdictData, b.nif.Target)
+			}
+		}
+		end := elements[len(buckets)]
+		if got := binaryutil.BigEndian.Uint32(end.Key); got != mod || !end.IntervalEnd {
+			t.Errorf("ratios %v: closing element %d (end %v), want %d", ratios, got, end.IntervalEnd, mod)
+		}
+
+		// Marks replace verdicts in mark mode
+		for n, e := range makeVmapElements(mod, buckets, true)[:len(buckets)] {
+			if e.VerdictData != nil || binaryutil.NativeEndian.Uint32(e.Val) != uint32(buckets[n].nif.Mark) {
+				t.Errorf("ratios %v: marked element %d is %+v, want mark %#x", ratios, n, e, buckets[n].nif.Mark)
+			}
+		}
+	}
+}
+
+// A load balancer across ratios of interfaces, made the only one
+// configured, with NFTables connections dialing fn
+func testLB(t *testing.T, fn nltest.Func, ratios ...int) *loadBalancer {
+	t.Helper()
+	savedConfig, savedNFT, savedOptions := config, nft, nftOptions
+	t.Cleanup(func() {
+		config, nft, nftOptions = savedConfig, savedNFT, savedOptions
+	})
+
+	table := &nftables.Table{Name: "t", Family: nftables.TableFamilyINet}
+	lb := &loadBalancer{
+		Name:    "lb",
+		Table:   lbTableConfig{Family: "inet", Name: "t"},
+		Chain:   "lb",
+		HashKey: defHashKey,
+		Mode:    "goto",
+		table:   table,
+		chain:   &nftables.Chain{Name: "lb", Table: table},
+		nifs:    testInterfaces(ratios...),
+	}
+	config = &vpsInstance{LoadBalancers: []*loadBalancer{lb}}
+	nftOptions = []nftables.ConnOption{nftables.WithTestDial(fn)}
+	nft, _ = connectNFT()
+	return lb
+}
+
+// Fails the test if anything exits the process through the logger
+func trapExit(t *testing.T) {
+	t.Helper()
+	log.ExitFunc = func(code int) {
+		panic(fmt.Sprintf("exited with status %d", code))
+	}
+	t.Cleanup(func() { log.ExitFunc = nil })
+}
+
+func TestUpdateNFTFailureReturns(t *testing.T) {
+	trapExit(t)
+	failed := func(req []netlink.Message) ([]netlink.Message, error) {
+		return nil, unix.ENOENT
+	}
+	lb := testLB(t, failed, 3, 7)
+	lb.status = "a"
+
+	for _, status := range []string{"all", "b", "fallback"} {
+		if err := updateNFT(status); err == nil {
+			t.Errorf("updateNFT(%s) succeeded with NFTables failing", status)
+		}
+		if lb.status != "a" {
+			t.Errorf("updateNFT(%s) failing changed status to %s", status, lb.status)
+		}
+	}
+	if err := lb.makeTarget(lb.nifs[0]); err == nil {
+		t.Error("makeTarget succeeded with NFTables failing")
+	}
+}
+
+// Ruleset changes in a batch sent to NFTables, which applies
+// each batch as one transaction
+type nftChange struct {
+	msg   int // NFT_MSG_DELRULE or NFT_MSG_NEWRULE
+	chain string
+}
+
+// Records the rule changes of each batch sent, acknowledging all
+type batchRecorder struct {
+	batches [][]nftChange
+}
+
+func (r *batchRecorder) dial(req []netlink.Message) ([]netlink.Message, error) {
+	if req == nil {
+		return nil, io.EOF
+	}
+	var changes []nftChange
+	for _, m := range req {
+		msg := int(m.Header.Type) &^ (unix.NFNL_SUBSYS_NFTABLES << 8)
+		if msg != unix.NFT_MSG_DELRULE && msg != unix.NFT_MSG_NEWRULE {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(m.Data[4:])
+		if err != nil {
+			return nil, err
+		}
+		c := nftChange{msg: msg}
+		for ad.Next() {
+			if ad.Type() == unix.NFTA_RULE_CHAIN {
+				c.chain = ad.String()
+			}
+		}
+		changes = append(changes, c)
+	}
+	r.batches = append(r.batches, changes)
+	return nil, nil
+}
+
+func TestRouteNeverEmptiesChain(t *testing.T) {
+	for _, status := range []string{"all", "a|c", "b", "fallback"} {
+		t.Run(status, func(t *testing.T) {
+			var rec batchRecorder
+			lb := testLB(t, rec.dial, 2, 3, 5)
+			config.FallbackTarget = "fallback"
+			if err := lb.route(status); err != nil {
+				t.Fatal(err)
+			}
+
+			// Replaying each transaction, the chain's single
+			// rule is only ever swapped, never left flushed.
+			// The flush deletes all rules at once
+			rules := 1
+			for n, batch := range rec.batches {
+				for _, c := range batch {
+					if c.chain != lb.chain.Name {
+						continue
+					}
+					if c.msg == unix.NFT_MSG_DELRULE {
+						rules = 0
+					} else {
+						rules++
+					}
+				}
+				if rules != 1 {
+					t.Errorf("batch %d of %d leaves the chain with %d rules: %+v", n+1, len(rec.batches), rules, batch)
+				}
+			}
+			if len(rec.batches) != 1 {
+				t.Errorf("rule swapped in %d transactions, want 1", len(rec.batches))
+			}
+		})
+	}
+}
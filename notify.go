@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Chat notifications are rate limited
+	chatMu         sync.Mutex
+	lastChatNotify time.Time
+	chatSuppressed int
+)
+
+type (
+	// Sent to notifyWebhook when currentStatus changes
+	transitionEvent struct {
+		Time      time.Time           `json:"time"`
+		Hostname  string              `json:"hostname"`
+		OldStatus string              `json:"oldStatus"`
+		NewStatus string              `json:"newStatus"`
+		Healthy   []string            `json:"healthy"`
+		Unhealthy []string            `json:"unhealthy"`
+		Reasons   map[string][]string `json:"reasons"`
+	}
+)
+
+// Builds a transition event from current interface state
+// Reasons come from each interface's last completed check
+func newTransitionEvent(oldStatus string, newStatus string) *transitionEvent {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Warnf("Failed to determine hostname for notifications: %+v", err)
+	}
+	event := &transitionEvent{
+		Time:      time.Now(),
+		Hostname:  hostname,
+		OldStatus: oldStatus,
+		NewStatus: newStatus,
+		Reasons:   make(map[string][]string),
+	}
+	for _, i := range config.Interfaces {
+		if i.inService {
+			event.Healthy = append(event.Healthy, i.Name)
+		} else {
+			event.Unhealthy = append(event.Unhealthy, i.Name)
+		}
+		if i.lastStatus != nil {
+			if _, reasons := i.lastStatus.healthy(); len(reasons) > 0 {
+				event.Reasons[i.Name] = reasons
+			}
+		}
+	}
+	return event
+}
+
+// Delivers a transition event to all configured notifiers
+// Runs in the background, failures never affect routing.
+// Senders may outlive a reload, so they're handed the config
+// they use rather than reading it
+func notifyTransition(event *transitionEvent) {
+	if config.EventSocket != "" {
+		publishEvent(event)
+	}
+	if url, timeout := config.NotifyWebhook, config.notifyTimeout; url != "" {
+		go func() {
+			if err := postJSON(url, event, timeout); err != nil {
+				log.WithField("error", err).Error("Failed to deliver webhook notification")
+				return
+			}
+			log.Debugf("Delivered webhook notification %s -> %s", event.OldStatus, event.NewStatus)
+		}()
+	}
+	if config.SlackWebhook != "" || config.DiscordWebhook != "" {
+		notifyChat(event)
+	}
+}
+
+// Sends a readable transition message to Slack and Discord,
+// at most once per notifyRateLimit so flapping doesn't spam
+func notifyChat(event *transitionEvent) {
+	chatMu.Lock()
+	if time.Since(lastChatNotify) < config.notifyRateLimit {
+		chatSuppressed++
+		chatMu.Unlock()
+		log.Debugf("Rate limited chat notification %s -> %s", event.OldStatus, event.NewStatus)
+		return
+	}
+	lastChatNotify = time.Now()
+	suppressed := chatSuppressed
+	chatSuppressed = 0
+	chatMu.Unlock()
+
+	msg := formatTransition(event, suppressed)
+	slack, discord, timeout := config.SlackWebhook, config.DiscordWebhook, config.notifyTimeout
+	go func() {
+		if slack != "" {
+			if err := postJSON(slack, map[string]string{"text": msg}, timeout); err != nil {
+				log.WithField("error", err).Error("Failed to deliver Slack notification")
+			}
+		}
+		if discord != "" {
+			if err := postJSON(discord, map[string]string{"content": msg}, timeout); err != nil {
+				log.WithField("error", err).Error("Failed to deliver Discord notification")
+			}
+		}
+	}()
+}
+
+// Formats a transition event as a chat message, e.g.
+// :red_circle: wg0 unhealthy: Failed http-api, Failed wg_last_handshake
+func formatTransition(event *transitionEvent, suppressed int) string {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "%s: routing %s -> %s\n", event.Hostname, event.OldStatus, event.NewStatus)
+	for _, n := range event.Unhealthy {
+		fmt.Fprintf(&msg, ":red_circle: %s unhealthy", n)
+		if reasons := event.Reasons[n]; len(reasons) > 0 {
+			fmt.Fprintf(&msg, ": %s", strings.Join(reasons, ", "))
+		}
+		msg.WriteString("\n")
+	}
+	for _, n := range event.Healthy {
+		fmt.Fprintf(&msg, ":large_green_circle: %s healthy\n", n)
+	}
+	if suppressed > 0 {
+		fmt.Fprintf(&msg, "(%d earlier transitions rate limited)\n", suppressed)
+	}
+	return strings.TrimSuffix(msg.String(), "\n")
+}
+
+// POSTs a JSON body, giving up after timeout
+func postJSON(url string, body any, timeout time.Duration) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}
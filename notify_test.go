@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotifyWebhookOutlivesReload(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	savedConfig := config
+	t.Cleanup(func() { config = savedConfig })
+	config = &vpsInstance{NotifyWebhook: srv.URL, notifyTimeout: time.Second}
+	notifyTransition(&transitionEvent{OldStatus: "all", NewStatus: "wg0"})
+
+	// A reload swaps the config while the webhook is in flight
+	config = &vpsInstance{}
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("webhook not delivered")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	otelScope           = "vps-path-watcher" // Tracer, meter and service name
+	otelShutdownTimeout = 5 * time.Second    // Longest a reload or exit waits to flush telemetry
+)
+
+// OpenTelemetry SDK providers exporting over OTLP/HTTP, set up while
+// otelEndpoint is. Without them the global tracer is the API's no-op
+// and nothing is recorded. Only replaced by a config load, which
+// waits on checks first
+var (
+	otelEndpoint   string // Endpoint the providers export to
+	tracerProvider *sdktrace.TracerProvider
+	meterProvider  *sdkmetric.MeterProvider
+	otelGauges     struct {
+		inService    metric.Int64Gauge
+		passed       metric.Int64Gauge
+		latency      metric.Float64Gauge
+		peakInFlight metric.Int64Gauge
+	}
+)
+
+// Points the providers at config.OTelEndpoint, run on every load.
+// Providers for a changed or removed endpoint are shut down, flushing
+// what they hold. Failing to set up is logged and leaves telemetry
+// off, it never stops the watcher
+func initOTel() {
+	if config.OTelEndpoint == otelEndpoint {
+		return
+	}
+	shutdownOTel()
+	if config.OTelEndpoint == "" {
+		return
+	}
+
+	ctx := context.Background()
+	base := strings.TrimSuffix(config.OTelEndpoint, "/")
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", otelScope),
+			attribute.String("service.version", version),
+		),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		log.Warnf("Incomplete OpenTelemetry resource: %+v", err)
+	}
+	traceExporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(base+"/v1/traces"))
+	if err != nil {
+		log.Errorf("Failed to export traces to %s: %+v", base, err)
+		return
+	}
+	metricExporter, err := otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(base+"/v1/metrics"))
+	if err != nil {
+		log.Errorf("Failed to export metrics to %s: %+v", base, err)
+		traceExporter.Shutdown(ctx)
+		return
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(traceExporter),
+		sdktrace.WithResource(res),
+	)
+	meterProvider = sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)),
+		sdkmetric.WithResource(res),
+	)
+	meter := meterProvider.Meter(otelScope, metric.WithInstrumentationVersion(version))
+	otelGauges.inService, _ = meter.Int64Gauge("vps_path_watcher.interface.in_service",
+		metric.WithUnit("1"), metric.WithDescription("1 while the interface is routed to"))
+	otelGauges.passed, _ = meter.Int64Gauge("vps_path_watcher.check.passed",
+		metric.WithUnit("1"), metric.WithDescription("1 if the check passed its last run"))
+	otelGauges.latency, _ = meter.Float64Gauge("vps_path_watcher.check.latency",
+		metric.WithUnit("s"), metric.WithDescription("Duration of the check's last run"))
+	otelGauges.peakInFlight, _ = meter.Int64Gauge("vps_path_watcher.probes.peak_in_flight",
+		metric.WithUnit("1"), metric.WithDescription("Most probes in flight at once during the last run"))
+
+	otel.SetTracerProvider(tracerProvider)
+	otelEndpoint = config.OTelEndpoint
+	log.Infof("Exporting OpenTelemetry to %s", base)
+}
+
+// Flushes and stops the providers, turning telemetry off
+func shutdownOTel() {
+	if tracerProvider == nil {
+		return
+	}
+	otel.SetTracerProvider(tracenoop.NewTracerProvider())
+	ctx, cancel := context.WithTimeout(context.Background(), otelShutdownTimeout)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		log.Warnf("Failed to flush traces to %s: %+v", otelEndpoint, err)
+	}
+	if err := meterProvider.Shutdown(ctx); err != nil {
+		log.Warnf("Failed to flush metrics to %s: %+v", otelEndpoint, err)
+	}
+	tracerProvider, meterProvider, otelEndpoint = nil, nil, ""
+}
+
+// Runs the check's probe in a span, so its duration is the probe's,
+// with the interface and check as attributes and an error status if
+// it failed or ran out of time
+func (c *vpsHealthCheck) tracedRun(ctx context.Context) (success, known bool) {
+	if tracerProvider == nil {
+		return c.limitedRun(ctx)
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("nif", c.nif),
+		attribute.String("check", c.Name),
+		attribute.String("check.type", c.Type),
+		attribute.String("host", c.Host),
+	}
+	if c.srcIP != nil {
+		attrs = append(attrs, attribute.String("source.address", c.srcIP.String()))
+	}
+	ctx, span := otel.Tracer(otelScope).Start(ctx, "check "+c.Name,
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	defer span.End()
+
+	success, known = c.limitedRun(ctx)
+	if err := ctx.Err(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if !success {
+		span.SetStatus(codes.Error, "check failed")
+	}
+	return success, known
+}
+
+// Records the health of every interface on the gauges, sent by the
+// meter provider's periodic export. Reads i.status, so it's called
+// once checks are done and before they're reset
+func recordOTelGauges() {
+	if meterProvider == nil {
+		return
+	}
+	ctx := context.Background()
+	otelGauges.peakInFlight.Record(ctx, int64(takePeakProbes()))
+	for _, i := range config.Interfaces {
+		nif := attribute.String("nif", i.Name)
+		otelGauges.inService.Record(ctx, boolInt(i.inService), metric.WithAttributes(nif))
+
+		// Interfaces not due this run keep their last values
+		s := i.status
+		s.mu.Lock()
+		for name, ok := range s.healthChecks {
+			attrs := metric.WithAttributes(nif, attribute.String("check", name))
+			otelGauges.passed.Record(ctx, boolInt(ok), attrs)
+			if l, found := s.latency[name]; found {
+				otelGauges.latency.Record(ctx, l.Seconds(), attrs)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTelExportsSpansAndGauges(t *testing.T) {
+	var mu sync.Mutex
+	bodies := make(map[string][][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies[r.URL.Path] = append(bodies[r.URL.Path], body)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	savedConfig := config
+	t.Cleanup(func() {
+		shutdownOTel()
+		config = savedConfig
+	})
+	wg0 := &vpsInterface{Name: "wg0", inService: true}
+	config = &vpsInstance{OTelEndpoint: srv.URL + "/", Interfaces: []*vpsInterface{wg0}}
+	initOTel()
+	if tracerProvider == nil {
+		t.Fatal("no tracer provider with otelEndpoint set")
+	}
+
+	wg0.status = newInterfaceStatus(wg0)
+	wg0.status.reset(2)
+	for _, command := range []string{"true", "false"} {
+		c := &vpsHealthCheck{Name: command, Type: "exec", Command: command, nif: "wg0", tmout: time.Second}
+		success, _ := c.tracedRun(context.Background())
+		wg0.status.setCheck(c.Name, success, 10*time.Millisecond)
+	}
+	recordOTelGauges()
+
+	// Shutting down flushes both
+	shutdownOTel()
+	mu.Lock()
+	defer mu.Unlock()
+
+	spans := make(map[string]*tracepb.Span)
+	for _, body := range bodies["/v1/traces"] {
+		var req coltracepb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Fatal(err)
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					spans[s.Name] = s
+				}
+			}
+		}
+	}
+	for name, wantErr := range map[string]bool{"check true": false, "check false": true} {
+		s := spans[name]
+		if s == nil {
+			t.Errorf("no span %q in %v", name, spans)
+			continue
+		}
+		if gotErr := s.Status.GetCode() == tracepb.Status_STATUS_CODE_ERROR; gotErr != wantErr {
+			t.Errorf("span %q error status %v, want %v", name, gotErr, wantErr)
+		}
+		if s.EndTimeUnixNano <= s.StartTimeUnixNano {
+			t.Errorf("span %q has no duration", name)
+		}
+		var nif string
+		for _, a := range s.Attributes {
+			if a.Key == "nif" {
+				nif = a.Value.GetStringValue()
+			}
+		}
+		if nif != "wg0" {
+			t.Errorf("span %q nif %q, want wg0", name, nif)
+		}
+	}
+
+	metrics := make(map[string]bool)
+	for _, body := range bodies["/v1/metrics"] {
+		var req colmetricpb.ExportMetricsServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Fatal(err)
+		}
+		for _, rm := range req.ResourceMetrics {
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					metrics[m.Name] = true
+				}
+			}
+		}
+	}
+	for _, name := range []string{
+		"vps_path_watcher.interface.in_service",
+		"vps_path_watcher.check.passed",
+		"vps_path_watcher.check.latency",
+		"vps_path_watcher.probes.peak_in_flight",
+	} {
+		if !metrics[name] {
+			t.Errorf("no %s exported, got %v", name, metrics)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Prints the loaded config as YAML with defaults filled in and every
+// duration replaced by the value parsed from it, so what the watcher
+// decided can be compared to what was written. Credentials, header
+// values and chat webhooks are redacted. Returns the exit code
+func printConfig() int {
+	for _, i := range config.Interfaces {
+		i.Interval = i.interval.String()
+		if i.Wireguard && i.WGPeer != "" {
+			i.WGMaxHandshake = i.wgMaxHandshake.String()
+			i.WGMaxRxIdle = i.wgMaxRxIdle.String()
+		}
+		for n, c := range i.Checks {
+			c.Interval = c.reqInterval.String()
+			c.Timeout = c.tmout.String()
+			c.RetryBackoffMax = c.retryBackoffMax.String()
+			if c.maxRTT > 0 {
+				c.MaxRTT = 0
+				c.MaxRTTDuration = c.maxRTT.String()
+			}
+			r := c.redacted()
+			i.Checks[n] = &r
+		}
+	}
+	config.Interval = interval.String()
+	config.MinTimeOut = config.minTimeOut.String()
+	config.MaxTimeOut = config.maxTimeOut.String()
+	config.TickDeadline = config.tickDeadline.String()
+	config.Jitter = config.jitter.String()
+	config.StartupGrace = config.startupGrace.String()
+	config.CacheTTL = config.cacheTTL.String()
+	config.NotifyTimeout = config.notifyTimeout.String()
+	config.NotifyRateLimit = config.notifyRateLimit.String()
+	for _, hook := range []*string{&config.SlackWebhook, &config.DiscordWebhook} {
+		if *hook != "" {
+			*hook = redacted
+		}
+	}
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode config: %v\n", err)
+		return 1
+	}
+	fmt.Printf("# Effective config from %s, resolved %s\n", configFile, time.Now().Format(time.RFC3339))
+	os.Stdout.Write(out)
+	return 0
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Reloads asked for over the status server, run by the main loop
+// like SIGHUP so no check run starts mid-reload. Each request
+// carries where to send the load's errors, none if accepted
+var reloadRequests = make(chan chan []error)
+
+type reloadResult struct {
+	Reloaded bool     `json:"reloaded"`
+	Config   string   `json:"config"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// POST /reload reloads the config as SIGHUP does, reporting whether
+// it was accepted. A config that fails validation is rejected with
+// 422 and the running config kept
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Buffered so the main loop never waits on a gone caller
+	reply := make(chan []error, 1)
+	select {
+	case reloadRequests <- reply:
+	case <-r.Context().Done():
+		return
+	}
+	var errs []error
+	select {
+	case errs = <-reply:
+	case <-r.Context().Done():
+		return
+	}
+
+	result := reloadResult{Reloaded: len(errs) == 0, Config: configFile}
+	for _, e := range errs {
+		result.Errors = append(result.Errors, e.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Reloaded {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(result)
+}
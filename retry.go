@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// Checks retry concurrently, the shared source needs a lock
+	retryRandMu sync.Mutex
+	retryRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Waits before retrying after the given failed attempt, counted
+// from 1. The wait is interval unless retryBackoff is exponential,
+// which doubles it each attempt up to retryBackoffMax. retryJitter
+// then picks a random wait between half and all of it
+func (c *vpsHealthCheck) retryWait(attempt int) time.Duration {
+	wait := c.reqInterval
+	if c.RetryBackoff == "exponential" {
+		for n := 1; n < attempt && wait < c.retryBackoffMax; n++ {
+			wait *= 2
+		}
+		if wait > c.retryBackoffMax {
+			wait = c.retryBackoffMax
+		}
+	}
+	if c.RetryJitter && wait > 1 {
+		retryRandMu.Lock()
+		wait = wait/2 + time.Duration(retryRand.Int63n(int64(wait/2)+1))
+		retryRandMu.Unlock()
+	}
+	return wait
+}
+
+// Sleeps retryWait after a failed attempt, cut short by ctx
+func (c *vpsHealthCheck) sleepRetry(ctx context.Context, attempt int) {
+	wait := c.retryWait(attempt)
+	log.WithFields(logrus.Fields{
+		"check":   c.Name,
+		"attempt": attempt,
+		"backoff": c.RetryBackoff,
+		"wait":    wait,
+	}).Trace("Waiting to retry check")
+	sleepCtx(ctx, wait)
+}
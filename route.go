@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// Parses ExpectRoute, a destination prefix or default, which is
+// the IPv4 default route unless written ::/0
+func parseExpectRoute(route string) (*net.IPNet, error) {
+	if route == "default" {
+		route = "0.0.0.0/0"
+	}
+	_, dst, err := net.ParseCIDR(route)
+	if err != nil {
+		return nil, fmt.Errorf("expectRoute %s is not a prefix or default", route)
+	}
+	return dst, nil
+}
+
+// Looks for ExpectRoute leaving this interface in the kernel routing
+// tables, recorded as route_present. Catches a routing daemon
+// withdrawing the route while the link stays up. Without permission
+// to dump routes the check is skipped rather than failed
+func (i *vpsInterface) checkRoute() {
+	if i.status.healthChecks == nil {
+		i.status.reset(len(i.Checks))
+	}
+	fields := logrus.Fields{
+		"nif":         i.Name,
+		"expectRoute": i.ExpectRoute,
+		"table":       i.ExpectRouteTable,
+	}
+	present, err := routePresent(i.expectRoute, i.ExpectRouteTable, i.nif.Index)
+	if errors.Is(err, os.ErrPermission) {
+		log.WithFields(fields).WithField("error", err).
+			Warn("Not permitted to read routes, skipping route check")
+		return
+	}
+	if err != nil {
+		log.WithFields(fields).WithField("error", err).
+			Warn("Check Failed reading routes")
+	} else if !present {
+		log.WithFields(fields).Warn("Check Failed Route Missing")
+	}
+	i.status.setCheck("route_present", present, 0)
+}
+
+// Dumps the routing tables and reports whether dst has a route out
+// of ifindex, directly or as one of its multipath next hops. Table
+// 0 matches any table. The out interface is matched here rather than
+// with RT_FILTER_OIF, which only compares a route's own RTA_OIF and
+// so never matches a multipath route
+func routePresent(dst *net.IPNet, table int, ifindex int) (bool, error) {
+	family := netlink.FAMILY_V4
+	if dst.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	filter := &netlink.Route{Dst: dst, Table: table}
+	present := false
+	err := netlink.RouteListFilteredIter(family, filter, netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE,
+		func(r netlink.Route) bool {
+			present = r.LinkIndex == ifindex
+			for _, hop := range r.MultiPath {
+				present = present || hop.LinkIndex == ifindex
+			}
+			return !present
+		})
+	// An interrupted dump may have missed the route, not invented one
+	if err != nil && !present {
+		return false, err
+	}
+	return present, nil
+}
+
+// Looks for a global unicast IPv6 address on the interface, within
+// IPv6Prefix when set, recorded as ipv6_address. SLAAC picks the
+// address, so only its scope and prefix can be expected
+func (i *vpsInterface) checkIPv6Address() {
+	if i.status.healthChecks == nil {
+		i.status.reset(len(i.Checks))
+	}
+	ip := i.globalIPv6()
+	if ip == nil {
+		log.WithFields(logrus.Fields{
+			"nif":        i.Name,
+			"ipv6Prefix": i.IPv6Prefix,
+		}).Warn("Check Failed No Global IPv6 Address")
+	} else {
+		log.Debugf("Interface %s has IPv6 address %s", i.Name, ip)
+	}
+	i.status.setCheck("ipv6_address", ip != nil, 0)
+}
+
+// First global unicast IPv6 address assigned, in ipv6Prefix if set
+func (i *vpsInterface) globalIPv6() net.IP {
+	addrs, err := i.nif.Addrs()
+	if err != nil {
+		log.Errorf("Failed to get interface %s addresses: %+v", i.Name, err)
+		return nil
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if i.ipv6Prefix == nil || i.ipv6Prefix.Contains(ipNet.IP) {
+			return ipNet.IP
+		}
+	}
+	return nil
+}
+
+// Looks for a usable neighbor flagged as a router on the interface,
+// recorded as ipv6_router. Router advertisements add the entry, so
+// it goes missing when the upstream router stops sending them
+func (i *vpsInterface) checkIPv6Router() {
+	if i.status.healthChecks == nil {
+		i.status.reset(len(i.Checks))
+	}
+	present, err := routerPresent(i.nif.Index)
+	if errors.Is(err, os.ErrPermission) {
+		log.WithFields(logrus.Fields{
+			"nif":   i.Name,
+			"error": err,
+		}).Warn("Not permitted to read neighbors, skipping IPv6 router check")
+		return
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"nif":   i.Name,
+			"error": err,
+		}).Warn("Check Failed reading IPv6 neighbors")
+	} else if !present {
+		log.WithField("nif", i.Name).Warn("Check Failed No IPv6 Router")
+	}
+	i.status.setCheck("ipv6_router", present, 0)
+}
+
+// Dumps the IPv6 neighbor table and reports whether ifindex has a
+// router entry that isn't failed or still resolving
+func routerPresent(ifindex int) (bool, error) {
+	neighs, err := netlink.NeighList(ifindex, netlink.FAMILY_V6)
+	if err != nil && !errors.Is(err, netlink.ErrDumpInterrupted) {
+		return false, err
+	}
+	for _, n := range neighs {
+		if n.Flags&netlink.NTF_ROUTER == 0 {
+			continue
+		}
+		if n.State != netlink.NUD_NONE && n.State&(netlink.NUD_INCOMPLETE|netlink.NUD_FAILED) == 0 {
+			return true, nil
+		}
+	}
+	return false, err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestRoutePresent(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	dst, _ := parseExpectRoute("127.0.0.0/8")
+
+	// The kernel puts 127.0.0.0/8 out lo in the local table
+	for _, tt := range []struct {
+		table   int
+		ifindex int
+		want    bool
+	}{
+		{0, lo.Index, true},
+		{255, lo.Index, true},
+		{254, lo.Index, false},
+		{0, lo.Index + 1000, false},
+	} {
+		got, err := routePresent(dst, tt.table, tt.ifindex)
+		if errors.Is(err, os.ErrPermission) {
+			t.Skipf("not permitted to read routes: %v", err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("routePresent(%s, table %d, ifindex %d) = %v, want %v",
+				dst, tt.table, tt.ifindex, got, tt.want)
+		}
+	}
+}
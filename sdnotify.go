@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// Sends state (READY=1, WATCHDOG=1) to systemd over NOTIFY_SOCKET
+// A no-op when not started by systemd with Type=notify
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// Abstract namespace sockets are given with a leading @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Warnf("Failed to connect to systemd notify socket: %+v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Warnf("Failed to notify systemd %s: %+v", state, err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	tickMu       sync.Mutex
+	lastTickTime time.Time     // Start of the last checkInterfaces
+	tickInterval time.Duration // Interval in effect at lastTickTime
+)
+
+// Records the start of a check run for /healthz
+func recordTick() {
+	tickMu.Lock()
+	defer tickMu.Unlock()
+	lastTickTime = time.Now()
+	tickInterval = tick
+}
+
+// Serves process status on config.StatusListen, read at startup
+// Failure to listen is logged, the watcher keeps running
+func startStatusServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/history", handleHistory)
+	mux.HandleFunc("/downtime", handleDowntime)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/drain/", handleDrain)
+	mux.HandleFunc("/undrain/", handleUndrain)
+	mux.HandleFunc("/reload", handleReload)
+	addr := config.StatusListen
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		log.Infof("Serving status on %s", addr)
+		if err := server.ListenAndServe(); err != nil {
+			log.Errorf("Status server on %s stopped: %+v", addr, err)
+		}
+	}()
+}
+
+// Liveness of the watcher itself, not the paths it watches
+// 503 once the main loop hasn't ticked within twice the interval
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	tickMu.Lock()
+	since := time.Since(lastTickTime)
+	limit := 2 * tickInterval
+	tickMu.Unlock()
+
+	probes := inFlightProbes()
+	if since > limit {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "stuck, last tick %s ago, %d probes in flight\n", since.Round(time.Millisecond), probes)
+		return
+	}
+	fmt.Fprintf(w, "ok, last tick %s ago, %d probes in flight\n", since.Round(time.Millisecond), probes)
+}
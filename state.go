@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Reads the status saved by saveState, returning empty if the
+// file is missing, unreadable, or names unknown interfaces
+func loadState() string {
+	if config.StateFile == "" || config.DryRun {
+		return ""
+	}
+	data, err := ioutil.ReadFile(config.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Failed to read state file %s: %+v", config.StateFile, err)
+		}
+		return ""
+	}
+	status := strings.TrimSpace(string(data))
+	if !validStatus(status) {
+		log.WithField("status", status).Warnf("Ignoring unrecognized status in state file %s", config.StateFile)
+		return ""
+	}
+	return status
+}
+
+// Writes status to the state file, replacing it atomically
+func saveState(status string) {
+	if config.StateFile == "" || config.DryRun {
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(config.StateFile), ".vps-path-watcher-state")
+	if err == nil {
+		_, err = tmp.WriteString(status + "\n")
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), config.StateFile)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to write state file %s: %+v", config.StateFile, err)
+	}
+}
+
+// True if status is "all", an enabled "fallback", or a
+// subset of configured interfaces
+func validStatus(status string) bool {
+	if status == "all" || (status == "fallback" && config.AllDownPolicy == "fallback") {
+		return true
+	}
+	if status == "" {
+		return false
+	}
+	for _, name := range strings.Split(status, "|") {
+		found := false
+		for _, i := range config.Interfaces {
+			if i.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Kernel interface counters, one line per interface after two headers
+const procNetDev = "/proc/net/dev"
+
+// Requires the interface byte counters to each grow by
+// MinTrafficBytes since the previous check, recorded as
+// traffic_flowing. Catches a path that is up and addressed but
+// carrying nothing. The first reading, and one after the counters
+// reset, only records a baseline
+func (i *vpsInterface) checkTraffic() {
+	if i.status.healthChecks == nil {
+		i.status.reset(len(i.Checks))
+	}
+	fields := logrus.Fields{
+		"nif":             i.Name,
+		"minTrafficBytes": i.MinTrafficBytes,
+	}
+	rx, tx, err := readTrafficCounters(i.Name)
+	if err != nil {
+		log.WithFields(fields).WithField("error", err).Warn("Check Failed reading interface counters")
+		i.status.setCheck("traffic_flowing", false, 0)
+		return
+	}
+
+	now := time.Now()
+	baseline := i.trafficAt.IsZero() || rx < i.trafficRx || tx < i.trafficTx
+	rxDelta, txDelta := rx-i.trafficRx, tx-i.trafficTx
+	since := now.Sub(i.trafficAt)
+	i.trafficRx, i.trafficTx, i.trafficAt = rx, tx, now
+	if baseline {
+		log.WithFields(fields).Debug("Recorded interface traffic baseline")
+		i.status.setCheck("traffic_flowing", true, 0)
+		return
+	}
+
+	fields["rxBytes"], fields["txBytes"], fields["since"] = rxDelta, txDelta, since.Round(time.Millisecond)
+	flowing := rxDelta >= uint64(i.MinTrafficBytes) && txDelta >= uint64(i.MinTrafficBytes)
+	if !flowing {
+		log.WithFields(fields).Warn("Check Failed Interface Traffic Not Flowing")
+	} else {
+		log.WithFields(fields).Debug("Interface traffic flowing")
+	}
+	i.status.setCheck("traffic_flowing", flowing, 0)
+}
+
+// Received and transmitted bytes of an interface from procNetDev
+func readTrafficCounters(name string) (rx, tx uint64, err error) {
+	f, err := os.Open(procNetDev)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	// "  eth0: rxbytes packets errs drop fifo frame compressed
+	// multicast txbytes ...", the colon may touch the first count
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		nif, counts, ok := strings.Cut(s.Text(), ":")
+		if !ok || strings.TrimSpace(nif) != name {
+			continue
+		}
+		c := strings.Fields(counts)
+		if len(c) < 9 {
+			return 0, 0, fmt.Errorf("short %s line for %s", procNetDev, name)
+		}
+		if rx, err = strconv.ParseUint(c[0], 10, 64); err != nil {
+			return 0, 0, err
+		}
+		if tx, err = strconv.ParseUint(c[8], 10, 64); err != nil {
+			return 0, 0, err
+		}
+		return rx, tx, nil
+	}
+	if err := s.Err(); err != nil {
+		return 0, 0, err
+	}
+	return 0, 0, fmt.Errorf("%s not in %s", name, procNetDev)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Sends SendData to Host:Port over UDP and waits tmout for a reply,
+// any bytes pass unless ExpectRegEx is set. UDP has no handshake, so
+// a firewall dropping the reply reads as a failure. NoResponse only
+// requires the send to succeed
+func (c *vpsHealthCheck) checkUDP(ctx context.Context) bool {
+	// Compiled at config load, nil without ExpectRegEx
+	re := c.expectRe
+
+	target := net.JoinHostPort(c.Host, c.Port)
+	for i := -1; i < c.Retries && ctx.Err() == nil; i++ {
+		start := time.Now()
+		err := c.exchangeUDP(ctx, target, re)
+		c.latency = time.Since(start)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"check":       c.Name,
+				"target":      target,
+				"expectRegEx": c.ExpectRegEx,
+				"error":       err,
+			}).Warnf("Check Failed UDP Exchange attempt %d", i+2)
+			c.sleepRetry(ctx, i+2)
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Writes sendData and reads datagrams until one matches re,
+// or any non-empty one arrives if re is nil, deadlined at tmout
+func (c *vpsHealthCheck) exchangeUDP(ctx context.Context, target string, re *regexp.Regexp) error {
+	d := c.dialer()
+	if d.LocalAddr != nil {
+		d.LocalAddr = &net.UDPAddr{IP: c.srcIP, Port: c.SourcePort}
+	}
+	conn, err := d.DialContext(ctx, "udp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(ioDeadline(ctx, c.tmout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte(c.SendData)); err != nil {
+		return err
+	}
+	if c.NoResponse {
+		return nil
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		log.Tracef("UDP Response for %s: %q", c.Name, buf[:n])
+		if n > 0 && (re == nil || re.Match(buf[:n])) {
+			return nil
+		}
+	}
+}
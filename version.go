@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Set at build time, e.g.
+// go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+func versionString() string {
+	return fmt.Sprintf("vps-path-watcher %s (commit %s, built %s, %s)",
+		version, commit, buildDate, runtime.Version())
+}
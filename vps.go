@@ -1,125 +1,310 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"regexp"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-ping/ping"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 const (
-	defICMPPings = 3
+	defICMPPings   = 3
+	redacted       = "[REDACTED]" // Stand-in for credentials in logs
+	maxTCPResponse = 64 * 1024    // Most TCP response read looking for expectRegEx
+	rttEWMAWeight  = 0.2          // Weight of each new RTT sample in the baseline
 )
 
 type (
 	// Configuration for VPS Path Watcher
-	// LBTable and LBChain determine where
-	// load balancer rules are placed
+	// LoadBalancers determine where load balancer rules
+	// are placed, LBTable and LBChain configure a single one
 	vpsInstance struct {
-		Interval   string // Golang time duration e.g. 5s, 500ms, 1m30s
-		Interfaces []*vpsInterface
-		MinTimeOut string `yaml:"minimumTimeOut"` // Minimum amount of time unhealthy interface is pulled
-		LBTable    struct {
-			Family string // ip ip6 inet etc...
-			Name   string // Name of table
-		}
-		LBChain    string
-		minTimeOut time.Duration
+		Interval            string // Golang time duration e.g. 5s, 500ms, 1m30s
+		Interfaces          []*vpsInterface
+		MinTimeOut          string `yaml:"minimumTimeOut" toml:"minimumTimeOut"` // Minimum amount of time unhealthy interface is pulled
+		MaxTimeOut          string `yaml:"maximumTimeOut" toml:"maximumTimeOut"` // Cap on the time out as consecutive failures double it
+		TickDeadline        string `yaml:"tickDeadline" toml:"tickDeadline"`     // Golang time duration, limit on an interface's checks, defaults to interval
+		Jitter              string `yaml:"jitter" toml:"jitter"`                 // Golang time duration, random delay up to this before each interface's checks
+		StartupGrace        string `yaml:"startupGrace" toml:"startupGrace"`     // Golang time duration, collect health without changing NFTables for this long after starting
+		CacheTTL            string `yaml:"cacheTTL" toml:"cacheTTL"`             // Golang time duration, identical unbound checks on several interfaces share a result this long
+		LBTable             lbTableConfig
+		LBChain             string
+		LBChainType         string          `yaml:"lbChainType" toml:"lbChainType"`                   // Create LBChain as a base chain of this type: filter, route or nat
+		LBChainHook         string          `yaml:"lbChainHook" toml:"lbChainHook"`                   // Base chain hook: prerouting, input, forward, output, postrouting
+		LBChainPriority     string          `yaml:"lbChainPriority" toml:"lbChainPriority"`           // Base chain priority, a name (raw, mangle, filter...) or integer, defaults to filter
+		LoadBalancers       []*loadBalancer `yaml:"loadBalancers" toml:"loadBalancers"`               // Several independent LB chains, instead of LBTable and LBChain
+		HashKey             []string        `yaml:"hashKey" toml:"hashKey"`                           // Fields the LB hash is keyed on, defaults to saddr, etherSaddr, l4proto, sport
+		LBMode              string          `yaml:"lbMode" toml:"lbMode"`                             // How the LB hash routes: goto (default) interface targets, or mark sets interface marks for ip rules
+		DryRun              bool            `yaml:"dryRun" toml:"dryRun"`                             // Log NFTables changes without applying them
+		LogFormat           string          `yaml:"logFormat" toml:"logFormat"`                       // text (default) or json
+		LogFile             string          `yaml:"logFile" toml:"logFile"`                           // Log to this file instead of stderr
+		StateFile           string          `yaml:"stateFile" toml:"stateFile"`                       // Persist the routed status here across restarts
+		LogMaxSize          int             `yaml:"logMaxSize" toml:"logMaxSize"`                     // Megabytes before rotating logFile, defaults to 100
+		LogMaxBackups       int             `yaml:"logMaxBackups" toml:"logMaxBackups"`               // Rotated log files to keep, 0 keeps all
+		LogMaxAge           int             `yaml:"logMaxAge" toml:"logMaxAge"`                       // Days to keep rotated log files, 0 keeps all
+		WatchConfig         bool            `yaml:"watchConfig" toml:"watchConfig"`                   // Reload when the config file changes
+		StatusListen        string          `yaml:"statusListen" toml:"statusListen"`                 // Address for the status HTTP server (e.g. :9090), read at startup
+		HistoryDepth        int             `yaml:"historyDepth" toml:"historyDepth"`                 // Check results kept per interface for /history and SIGUSR1, 0 keeps none
+		KeepUnhealthyTotal  bool            `yaml:"keepUnhealthyTotal" toml:"keepUnhealthyTotal"`     // Keep counting totalUnhealthy across reloads instead of resetting
+		MaxConcurrency      int             `yaml:"maxConcurrency" toml:"maxConcurrency"`             // Interfaces checked at once, defaults to all of them
+		MaxConcurrentChecks int             `yaml:"maxConcurrentChecks" toml:"maxConcurrentChecks"`   // Probes in flight at once across all interfaces, 0 is unlimited
+		HealthyThreshold    int             `yaml:"healthyThreshold" toml:"healthyThreshold"`         // Consecutive healthy checks before an interface is restored
+		UnhealthyThreshold  int             `yaml:"unhealthyThreshold" toml:"unhealthyThreshold"`     // Consecutive unhealthy checks before an interface is removed
+		MinHealthyIfaces    int             `yaml:"minHealthyInterfaces" toml:"minHealthyInterfaces"` // Keep the current status rather than narrow below this many healthy interfaces
+		AllDownPolicy       string          `yaml:"allDownPolicy" toml:"allDownPolicy"`               // With no healthy interfaces: keep (default) the current rule, fallback, or all
+		FallbackTarget      string          `yaml:"fallbackTarget" toml:"fallbackTarget"`             // Chain to goto for allDownPolicy fallback
+		CleanupOnExit       string          `yaml:"cleanupOnExit" toml:"cleanupOnExit"`               // On SIGINT or SIGTERM: leave (default) the rules, flush the LB chains, or route to all
+		NotifyWebhook       string          `yaml:"notifyWebhook" toml:"notifyWebhook"`               // URL to POST JSON status transitions to
+		NotifyTimeout       string          `yaml:"notifyTimeout" toml:"notifyTimeout"`               // Golang time duration, timeout delivering notifications
+		SlackWebhook        string          `yaml:"slackWebhook" toml:"slackWebhook"`                 // Slack incoming webhook for readable transition messages
+		DiscordWebhook      string          `yaml:"discordWebhook" toml:"discordWebhook"`             // Discord webhook for readable transition messages
+		NotifyRateLimit     string          `yaml:"notifyRateLimit" toml:"notifyRateLimit"`           // Golang time duration, minimum time between chat messages
+		HookTimeout         string          `yaml:"hookTimeout" toml:"hookTimeout"`                   // Golang time duration, limit on onHealthy and onUnhealthy commands
+		EventSocket         string          `yaml:"eventSocket" toml:"eventSocket"`                   // Unix socket path streaming transitions as JSON lines, read at startup
+		OTelEndpoint        string          `yaml:"otelEndpoint" toml:"otelEndpoint"`                 // OTLP/HTTP collector base URL (e.g. http://localhost:4318) for check spans and health gauges
+		minTimeOut          time.Duration
+		maxTimeOut          time.Duration
+		tickDeadline        time.Duration
+		jitter              time.Duration
+		startupGrace        time.Duration
+		cacheTTL            time.Duration
+		legacyLB            bool     // LoadBalancers built from LBTable and LBChain
+		disabled            []string // Names of interfaces dropped as disabled
+		notifyTimeout       time.Duration
+		notifyRateLimit     time.Duration
+		hookTimeout         time.Duration
+	}
+
+	// Table holding a load balancer's chains
+	lbTableConfig struct {
+		Family string // ip ip6 inet etc...
+		Name   string // Name of table
 	}
 
 	// Configuration for each downstream interface,
 	// most likely wireguard interfaces
 	vpsInterface struct {
-		Name           string // Actual interface name
-		Address        string // Interface address with subnet
-		Wireguard      bool   // Set to true if wireguard interface
-		WGPeer         string // Peer ID to check for liveness
-		WGMaxHandshake string `yaml:"wgLastHandshake"` // Max time since last peer handshake, go time (e.g. 1m30s)
-		Ratio          int8   // Scale of 1-10 (5 gets 50% of traffic)
-		Target         string // Name of chain to send packets
-		Mark           uint8  // Mark to add to packets. Does not create rule if left at 0x0
-		Counter        bool   // Use counter if Mark defined (managed rule)
-		Checks         []*vpsHealthCheck
-		nif            *net.Interface
-		status         *interfaceStatus
-		lastStatus     *interfaceStatus
-		lastUnhealthy  time.Time
-		wgMaxHandshake time.Duration
+		Name              string   // Actual interface name
+		Address           string   // Interface address with subnet, v4 or v6
+		Addresses         []string // Additional addresses with subnet, v4 or v6, all must be assigned
+		MatchAddressExact *bool    `yaml:"matchAddressExact" toml:"matchAddressExact"` // Require address and prefix length to match (default), false accepts the IP within any assigned prefix
+		Gateway           string   // Next hop to ping from the interface address before other checks
+		ExpectedMTU       int      `yaml:"expectedMTU" toml:"expectedMTU"`           // Fail the interface if its MTU differs, 0 skips
+		DynamicIPv6       bool     `yaml:"dynamicIPv6" toml:"dynamicIPv6"`           // Require a global IPv6 address, as assigned by SLAAC, rather than an exact one
+		IPv6Prefix        string   `yaml:"ipv6Prefix" toml:"ipv6Prefix"`             // Prefix the dynamic IPv6 address must fall within, implies dynamicIPv6
+		ExpectIPv6Router  bool     `yaml:"expectIPv6Router" toml:"expectIPv6Router"` // Require a router in the IPv6 neighbor table, learned from router advertisements
+		ExpectRoute       string   `yaml:"expectRoute" toml:"expectRoute"`           // Destination prefix or default that must be routed out this interface
+		ExpectRouteTable  int      `yaml:"expectRouteTable" toml:"expectRouteTable"` // Routing table holding expectRoute, 0 searches all of them
+		MinTrafficBytes   int64    `yaml:"minTrafficBytes" toml:"minTrafficBytes"`   // Fail unless received and sent bytes each grow this much between checks, 0 skips
+		Wireguard         bool     // Set to true if wireguard interface
+		WGPeer            string   // Peer ID to check for liveness
+		WGMaxHandshake    string   `yaml:"wgLastHandshake" toml:"wgLastHandshake"`       // Max time since last peer handshake, go time (e.g. 1m30s)
+		WGMaxRxIdle       string   `yaml:"wgMaxRxIdle" toml:"wgMaxRxIdle"`               // Max time without peer received bytes increasing, go time (e.g. 5m)
+		WGEndpointCheck   string   `yaml:"wgEndpointCheck" toml:"wgEndpointCheck"`       // Probe the peer endpoint when handshakes fail: udp, icmp, tcp
+		WGEndpointPort    string   `yaml:"wgEndpointPort" toml:"wgEndpointPort"`         // Port for a tcp endpoint probe
+		WGReflector       string   `yaml:"wgReflector" toml:"wgReflector"`               // URL of a service testing our listen port from outside, {port} is replaced with it
+		WGReflectTimeout  string   `yaml:"wgReflectorTimeout" toml:"wgReflectorTimeout"` // Go time, timeout for the reflector to answer, defaults to 5s
+		Ratio             int      // Share of traffic out of the sum of all ratios (3 and 7 split 30/70)
+		Target            string   // Name of chain to send packets
+		Interval          string   // Golang time duration between checks of this interface, the global interval by default
+		Verdict           string   // How the vmap sends packets to Target: goto (default), jump to return to the LB chain, or accept
+		Mark              uint8    // Mark to add to packets. Does not create rule if left at 0x0
+		Enabled           *bool    // Check and balance across the interface, true unless set false
+		Counter           bool     // Use counter if Mark defined (managed rule)
+		OnHealthy         []string `yaml:"onHealthy" toml:"onHealthy"`               // Command and arguments run when the interface returns to service
+		OnUnhealthy       []string `yaml:"onUnhealthy" toml:"onUnhealthy"`           // Command and arguments run when the interface is removed from service
+		MinHealthyChecks  int      `yaml:"minHealthyChecks" toml:"minHealthyChecks"` // Healthy once this many checks pass instead of all of them, 0 requires all
+		MinHealthyWeight  int      `yaml:"minHealthyWeight" toml:"minHealthyWeight"` // Healthy once passing check weights sum to this, 0 disables
+		Checks            []*vpsHealthCheck
+		nif               *net.Interface
+		status            *interfaceStatus
+		lastStatus        *interfaceStatus
+		history           []checkResult // Last historyDepth results, guarded by historyMu
+		totalUnhealthy    time.Duration // Time found unhealthy since downtimeStart, guarded by historyMu
+		downtimeStart     time.Time     // Start of totalUnhealthy accounting
+		lastCycle         time.Time     // End of the previous check cycle, see recordDowntime
+		lastUnhealthy     time.Time
+		interval          time.Duration // Parsed Interval
+		expectRoute       *net.IPNet    // Parsed ExpectRoute
+		ipv6Prefix        *net.IPNet    // Parsed IPv6Prefix
+		nextCheck         time.Time     // Checks skipped by the main loop until due, see checkInterfaces
+		wgMaxHandshake    time.Duration
+		wgMaxRxIdle       time.Duration
+		wgRxBytes         int64 // Peer received bytes at wgRxChanged
+		wgRxChanged       time.Time
+		trafficRx         uint64 // Received bytes at trafficAt
+		trafficTx         uint64 // Sent bytes at trafficAt
+		trafficAt         time.Time
+		wgEndpointProbe   *vpsHealthCheck
+		wgReflectorProbe  *vpsHealthCheck // Template filled per run, see checkWgInbound
+		gatewayProbe      *vpsHealthCheck
+		healthyStreak     int
+		unhealthyStreak   int
+		inService         bool          // Carrying traffic, see updateService
+		timeOut           time.Duration // Current penalty box, see updateTimeOut
+		parkedSince       time.Time     // First failure of the current time out, zero once back in service
 	}
 
 	// Configure the health check
 	vpsHealthCheck struct {
-		Name         string  // Name of health check
-		Type         string  // ICMP, TCP, UDP
-		Host         string  // Host to perform check against
-		Port         string  // 22, 443, etc..
-		Interval     string  // Golang time duration, interval between retries / pings
-		Timeout      string  // Golang time duration (e.g. 750ms, 2s, 1m12s). For ICMP, total time of all messages.
-		Retries      int     // Number of retries for check
-		Count        int     // ICMP: Number of pings to send
-		MaxRTT       int     // ICMP: Max AVERAGE Round-Trip Time
-		MaxLossPcnt  float64 // ICMP: Max percentage of packets lost
-		TLS          bool    // HTTP: Use TLS [HTTPS]
-		Insecure     bool    // HTTP: Valid Handshake
-		Method       string  // HTTP: Method for check (e.g. GET)
-		Path         string  // HTTP: Request path (e.g. /healthz)
-		MatchRegEx   string  `yaml:"matchRegEx"`   // HTTP: Expected Response RegEx
-		ResponseCode int     `yaml:"responseCode"` // HTTP: Expected Response Code (e.g. 200)
-		tmout        time.Duration
-		reqInterval  time.Duration
+		Name                string            // Name of health check
+		Weight              int               // Counts toward the interface minHealthyWeight, defaults to 1
+		FailuresToUnhealthy int               `yaml:"failuresToUnhealthy" toml:"failuresToUnhealthy"` // Consecutive failed runs before the check counts as failed, defaults to 1
+		Type                string            // icmp, tcp, udp, http, http3, grpc, tls, exec
+		Host                string            // Host to perform check against
+		Port                string            // 22, 443, etc..
+		Resolver            string            // DNS server (e.g. 1.1.1.1 or [2606:4700::1111]:53) for resolving Host, system DNS otherwise
+		Interval            string            // Golang time duration, interval between retries / pings
+		Timeout             string            // Golang time duration (e.g. 750ms, 2s, 1m12s). For ICMP, total time of all messages.
+		Retries             int               // Number of retries for check
+		RetryBackoff        string            `yaml:"retryBackoff" toml:"retryBackoff"`       // Wait between retries: fixed (default) at interval, or exponential from it
+		RetryBackoffMax     string            `yaml:"retryBackoffMax" toml:"retryBackoffMax"` // Golang time duration, cap on exponential waits, defaults to 10s
+		RetryJitter         bool              `yaml:"retryJitter" toml:"retryJitter"`         // Randomize each retry wait between half and all of it
+		Count               int               // ICMP: Number of pings to send
+		WarmupPings         int               `yaml:"warmupPings" toml:"warmupPings"` // ICMP: Throwaway pings sent before measuring, so first packet setup doesn't count
+		MaxRTT              int               // ICMP: Max AVERAGE Round-Trip Time in milliseconds
+		MaxRTTDuration      string            `yaml:"maxRTTDuration" toml:"maxRTTDuration"`   // ICMP: Max average RTT as a Golang duration (e.g. 1500us), preferred over maxRTT
+		MaxRTTDeviation     float64           `yaml:"maxRTTDeviation" toml:"maxRTTDeviation"` // ICMP: Fail when average RTT exceeds its moving average baseline by this factor (e.g. 3)
+		MaxLossPcnt         float64           // ICMP: Max percentage of packets lost
+		PacketSize          int               `yaml:"packetSize" toml:"packetSize"`         // ICMP: Echo payload bytes, 24 to 65507, replies shorter than sent fail the check
+		IPv6                bool              `yaml:"ipv6" toml:"ipv6"`                     // ICMP: Resolve Host to an IPv6 address, detected from a v6 literal or resolution otherwise
+		ICMPPrivileged      *bool             `yaml:"icmpPrivileged" toml:"icmpPrivileged"` // ICMP: Force raw (true) or unprivileged (false) sockets, detected otherwise
+		TLS                 bool              // HTTP: Use TLS [HTTPS]
+		Insecure            bool              // HTTP: Valid Handshake
+		Method              string            // HTTP: Method for check (GET, POST, PUT, HEAD, DELETE)
+		Path                string            // HTTP: Request path (e.g. /healthz)
+		Body                string            // HTTP: Request payload for POST and PUT
+		Headers             map[string]string // HTTP: Request headers, Host is applied to the request itself
+		BasicAuthUser       string            `yaml:"basicAuthUser" toml:"basicAuthUser"`       // HTTP: Basic auth username
+		BasicAuthPass       string            `yaml:"basicAuthPass" toml:"basicAuthPass"`       // HTTP: Basic auth password
+		BearerToken         string            `yaml:"bearerToken" toml:"bearerToken"`           // HTTP: Static bearer token, takes precedence over basic auth
+		MatchRegEx          string            `yaml:"matchRegEx" toml:"matchRegEx"`             // HTTP, Exec: Expected Response RegEx
+		ExpectJSON          map[string]string `yaml:"expectJSON" toml:"expectJSON"`             // HTTP: JSON body paths and expected values (e.g. .status: pass)
+		MaxBodyBytes        int               `yaml:"maxBodyBytes" toml:"maxBodyBytes"`         // HTTP: Most of the body read for matchRegEx and expectJSON, defaults to 64KiB
+		ResponseCode        int               `yaml:"responseCode" toml:"responseCode"`         // HTTP: Expected Response Code (e.g. 200)
+		ResponseCodes       responseCodes     `yaml:"responseCodes" toml:"responseCodes"`       // HTTP: Also accepted codes or ranges (e.g. [200, 204] or ["200-299"])
+		FollowRedirects     bool              `yaml:"followRedirects" toml:"followRedirects"`   // HTTP: Follow redirects, otherwise the 3xx itself is checked
+		ForceHTTP2          bool              `yaml:"forceHTTP2" toml:"forceHTTP2"`             // HTTP: Fail unless HTTP/2 is negotiated, TLS only
+		DisableKeepAlive    bool              `yaml:"disableKeepAlive" toml:"disableKeepAlive"` // HTTP: Open a fresh connection for every request, including retries
+		ReuseConnections    bool              `yaml:"reuseConnections" toml:"reuseConnections"` // HTTP: Keep pooled connections between runs instead of per run
+		ClientCertFile      string            `yaml:"clientCertFile" toml:"clientCertFile"`     // HTTP, gRPC: PEM client certificate for mTLS
+		ClientKeyFile       string            `yaml:"clientKeyFile" toml:"clientKeyFile"`       // HTTP, gRPC: PEM key for clientCertFile
+		CAFile              string            `yaml:"caFile" toml:"caFile"`                     // HTTP, gRPC: PEM CA bundle to verify the server, system roots otherwise
+		BindToInterface     bool              `yaml:"bindToInterface" toml:"bindToInterface"`   // Source the check from the interface address
+		Enabled             *bool             // Run the check, true unless set false
+		CheckAllAddresses   bool              `yaml:"checkAllAddresses" toml:"checkAllAddresses"` // With bindToInterface, pass only if the check passes from every interface address
+		SocketMark          uint32            `yaml:"socketMark" toml:"socketMark"`               // Firewall mark (SO_MARK) on check sockets, not applied to ICMP or exec
+		SourcePort          int               `yaml:"sourcePort" toml:"sourcePort"`               // Fixed source port for TCP, UDP, HTTP, gRPC and TLS checks
+		SendData            string            `yaml:"sendData" toml:"sendData"`                   // TCP, UDP: Payload to send
+		ExpectRegEx         string            `yaml:"expectRegEx" toml:"expectRegEx"`             // TCP, UDP: Expected response RegEx
+		NoResponse          bool              `yaml:"noResponse" toml:"noResponse"`               // UDP: Pass once sendData is sent, without waiting for a reply
+		MinCertDaysLeft     int               `yaml:"minCertDaysLeft" toml:"minCertDaysLeft"`     // TLS: Fail when the certificate expires within this many days
+		Command             string            // Exec: Command to run, passes on exit code 0
+		Args                []string          // Exec: Command arguments
+		tmout               time.Duration
+		reqInterval         time.Duration
+		failStreak          int // Consecutive failed runs, see countFailures
+		retryBackoffMax     time.Duration
+		responseCodes       []codeRange
+		maxRTT              time.Duration
+		matchRe             *regexp.Regexp // Compiled MatchRegEx
+		expectRe            *regexp.Regexp // Compiled ExpectRegEx
+		rttEWMA             time.Duration  // Moving average of passing RTT samples, see checkRTTBaseline
+		conns               *reusedConns   // Set with ReuseConnections, see httpTransport
+		srcIP               net.IP         // Set when bound to the interface
+		nif                 string         // Name of the interface it belongs to, for spans
+		latency             time.Duration  // Measured by the last run
+	}
+
+	// Transport shared by runs of a check, built on first use
+	reusedConns struct {
+		mu        sync.Mutex
+		transport *http.Transport
 	}
 
 	// Checks performed on interface
 	interfaceStatus struct {
-		exists       bool
-		up           bool
-		addressed    bool
-		healthChecks map[string]bool
-		time         time.Time
+		exists           bool
+		up               bool
+		addressed        bool
+		healthChecks     map[string]bool
+		latency          map[string]time.Duration // Last measured duration per check, ICMP is average RTT
+		details          map[string]bool          // Per address checkAllAddresses results, keyed check@addr
+		time             time.Time
+		mu               sync.Mutex     // Guards healthChecks while checks run
+		minHealthyChecks int            // Passing quorum checks needed, see healthy
+		quorum           map[string]int // Configured checks subject to the quorum, by weight
+		minHealthyWeight int            // Passing quorum weight needed, see healthy
 	}
 )
 
 // Perform all configured interface health checks
-func (i *vpsInterface) healthChecks() {
+func (i *vpsInterface) healthChecks(ctx context.Context) {
 	if i.status.healthChecks == nil {
 		i.status.reset(len(i.Checks))
 	}
 
-	// Perform provisionend checks
+	// Perform provisionend checks concurrently
+	var checks sync.WaitGroup
 	for _, c := range i.Checks {
-		log.Tracef("Running health check %+v", c)
+		log.Tracef("Running health check %+v", c.redacted())
 		log.WithFields(logrus.Fields{
 			"nif":   i.Name,
 			"check": c.Name,
 			"type":  c.Type,
 			"host":  c.Host,
 		}).Debug("Running Check")
-		i.healthCheck(c)
+		checks.Add(1)
+		go func(c *vpsHealthCheck) {
+			defer checks.Done()
+			i.healthCheck(ctx, c)
+		}(c)
 	}
+	checks.Wait()
 
-	// Perform WG Checks if configured
+	// Perform WG Checks if configured, after all others
 	if i.Wireguard {
-		checkWgHealth(i)
+		checkWgHealth(ctx, i)
 	}
 }
 
 // Execute and record a health check
-func (i *vpsInterface) healthCheck(c *vpsHealthCheck) {
+// Safe to run concurrently with other checks on the interface
+func (i *vpsInterface) healthCheck(ctx context.Context, c *vpsHealthCheck) {
+	if c.BindToInterface && c.CheckAllAddresses {
+		i.healthCheckAll(ctx, c)
+		return
+	}
 
-	switch c.Type {
-	case "tcp":
-		i.status.healthChecks[c.Name] = c.checkTCP()
-	case "icmp":
-		i.status.healthChecks[c.Name] = c.checkICMP()
-	case "http":
-		i.status.healthChecks[c.Name] = c.checkHTTP()
-	default:
+	// Make sure the check traverses the interface under test
+	if c.BindToInterface {
+		c.srcIP = i.sourceIP()
+		if c.srcIP == nil {
+			log.WithFields(logrus.Fields{
+				"nif":   i.Name,
+				"check": c.Name,
+				"addr":  i.Address,
+			}).Warn("Check Failed, no usable interface address to bind")
+			i.status.setCheck(c.Name, c.countFailures(false), 0)
+			return
+		}
+	}
+
+	success, known, _ := c.cachedRun(ctx)
+	if !known {
 		log.WithFields(logrus.Fields{
 			"nif":   i.Name,
 			"check": c.Name,
@@ -127,45 +312,153 @@ func (i *vpsInterface) healthCheck(c *vpsHealthCheck) {
 		}).Warn("Skipping Unknown Health Check")
 		return
 	}
+	i.status.setCheck(c.Name, c.countFailures(success), c.latency)
 	log.WithFields(logrus.Fields{
 		"nif":     i.Name,
 		"check":   c.Name,
 		"type":    c.Type,
 		"host":    c.Host,
-		"success": i.status.healthChecks[c.Name],
+		"success": success,
+		"latency": c.latency,
 	}).Debug("Check Complete")
 }
 
+// Runs a bound check from each interface address in turn, passing
+// only if all of them pass. Per address results are kept as
+// check@addr details, the slowest latency as the check's. ICMP
+// checks only use addresses of their resolved target's family
+func (i *vpsInterface) healthCheckAll(ctx context.Context, c *vpsHealthCheck) {
+	var v6 bool
+	if c.Type == "icmp" {
+		target, err := c.resolveIPAddr(ctx)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"nif":   i.Name,
+				"check": c.Name,
+				"host":  c.Host,
+				"error": err,
+			}).Warn("Check Failed resolving target")
+			i.status.setCheck(c.Name, c.countFailures(false), 0)
+			return
+		}
+		v6 = target.IP.To4() == nil
+	}
+	var ips []net.IP
+	for _, ip := range i.sourceIPs() {
+		if c.Type != "icmp" || (ip.To4() == nil) == v6 {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		log.WithFields(logrus.Fields{
+			"nif":   i.Name,
+			"check": c.Name,
+			"addr":  i.Address,
+		}).Warn("Check Failed, no usable interface address to bind")
+		i.status.setCheck(c.Name, c.countFailures(false), 0)
+		return
+	}
+
+	success := true
+	var slowest time.Duration
+	for _, ip := range ips {
+		c.srcIP = ip
+		c.latency = 0
+		ok, known, _ := c.cachedRun(ctx)
+		if !known {
+			log.WithFields(logrus.Fields{
+				"nif":   i.Name,
+				"check": c.Name,
+				"type":  c.Type,
+			}).Warn("Skipping Unknown Health Check")
+			return
+		}
+		i.status.setDetail(c.Name+"@"+ip.String(), ok, c.latency)
+		log.WithFields(logrus.Fields{
+			"nif":     i.Name,
+			"check":   c.Name,
+			"srcIP":   ip,
+			"success": ok,
+			"latency": c.latency,
+		}).Debug("Check Complete from Address")
+		success = success && ok
+		if c.latency > slowest {
+			slowest = c.latency
+		}
+	}
+	i.status.setCheck(c.Name, c.countFailures(success), slowest)
+}
+
+// Passes a failed run off as passing until failuresToUnhealthy
+// consecutive runs have failed, so a noisy check needs to keep
+// failing before it counts. A pass resets the streak
+func (c *vpsHealthCheck) countFailures(success bool) bool {
+	if success {
+		c.failStreak = 0
+		return true
+	}
+	c.failStreak++
+	if c.failStreak < c.FailuresToUnhealthy {
+		log.WithFields(logrus.Fields{
+			"check":               c.Name,
+			"failStreak":          c.failStreak,
+			"failuresToUnhealthy": c.FailuresToUnhealthy,
+		}).Info("Check failure tolerated")
+		return true
+	}
+	return false
+}
+
+// Runs the check for its type, known is false for unknown types
+func (c *vpsHealthCheck) run(ctx context.Context) (success, known bool) {
+	c.latency = 0
+	switch c.Type {
+	case "tcp":
+		return c.checkTCP(ctx), true
+	case "icmp":
+		return c.checkICMP(ctx), true
+	case "http":
+		return c.checkHTTP(ctx), true
+	case "http3":
+		return c.checkHTTP3(ctx), true
+	case "grpc":
+		return c.checkGRPC(ctx), true
+	case "tls":
+		return c.checkTLS(ctx), true
+	case "exec":
+		return c.checkExec(ctx), true
+	case "udp":
+		return c.checkUDP(ctx), true
+	}
+	return false, false
+}
+
 // Performans an HTTP health check
 // Supports interval, retries, method, path, response regex,
 // and expected response code
 //
 // Options for https and tlsVerify
-func (c *vpsHealthCheck) checkHTTP() bool {
-	// Prepare HTTP Client
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: c.Insecure,
+func (c *vpsHealthCheck) checkHTTP(ctx context.Context) bool {
+	// Prepare HTTP Client, certificates are loaded
+	// once and reused across retries
+	transport, err := c.httpTransport()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"check": c.Name,
+			"error": err,
+		}).Warn("Check Failed loading TLS certificates")
+		return false
 	}
-	transport := &http.Transport{
-		TLSClientConfig:     tlsConfig,
-		TLSHandshakeTimeout: c.tmout,
+	// A transport built for this run drops its pooled
+	// connections rather than leaving them to the idle timeout
+	if !c.ReuseConnections {
+		defer transport.CloseIdleConnections()
 	}
 	client := &http.Client{
 		Transport: transport,
 		Timeout:   c.tmout,
 	}
 
-	// Prepare RegEx
-	var re *regexp.Regexp
-	var err error
-	if c.MatchRegEx != "" {
-		re, err = regexp.Compile(c.MatchRegEx)
-		if err != nil {
-			log.Warnf("Check %s bad regex %s: %+v", c.Name, c.MatchRegEx, err)
-			return false
-		}
-	}
-
 	// Prepare URI
 	var proto string
 	if c.TLS {
@@ -173,60 +466,399 @@ func (c *vpsHealthCheck) checkHTTP() bool {
 	} else {
 		proto = "http"
 	}
-	uri := proto + "://" + c.Host + c.Path
+	return c.requestHTTP(ctx, client, proto+"://"+c.Host+c.Path)
+}
 
-	fields := map[string]any{
+// Requests uri with the check's method, retrying failed connections,
+// and judges the response. Shared by http and http3 checks
+func (c *vpsHealthCheck) requestHTTP(ctx context.Context, client *http.Client, uri string) bool {
+	// Judge the redirect itself unless asked to follow
+	if !c.FollowRedirects {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+
+	// Compiled at config load, nil without MatchRegEx
+	re := c.matchRe
+
+	fields := logrus.Fields{
 		"check":  c.Name,
 		"method": c.Method,
 		"path":   c.Path,
 		"uri":    uri,
 	}
 
-	// Make request and perform checks
+	// Never log credentials
+	if c.BasicAuthUser != "" {
+		fields["basicAuthUser"] = c.BasicAuthUser
+		fields["basicAuthPass"] = redacted
+	}
+	if c.BearerToken != "" {
+		fields["bearerToken"] = redacted
+	}
+
+	// Make sure we know how to make the request
 	switch c.Method {
-	case "GET":
-		for i := -1; i < c.Retries; i++ {
-			resp, err := client.Get(uri)
-			if err != nil {
-				log.WithFields(fields).WithField("error", err).
-					Warn("Check Failed HTTP Connect")
-				time.Sleep(c.reqInterval)
-				continue
-			}
-			// Check response code
-			if c.ResponseCode != resp.StatusCode {
-				log.WithFields(fields).WithFields(logrus.Fields{
-					"responseWanted":   c.ResponseCode,
-					"responseRecieved": resp.StatusCode,
-				}).Warn("Check Failed HTTP Response Code")
-				return false
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodHead, http.MethodDelete:
+	default:
+		log.WithFields(logrus.Fields{
+			"check":  c.Name,
+			"method": c.Method,
+		}).Warn("Unimplemented method, check failed")
+		return false
+	}
+
+	// Make request and perform checks
+	for i := -1; i < c.Retries && ctx.Err() == nil; i++ {
+		req, err := c.newHTTPRequest(ctx, uri)
+		if err != nil {
+			log.WithFields(fields).WithField("error", err).
+				Warn("Check Failed HTTP Request")
+			return false
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		c.latency = time.Since(start)
+		if err != nil {
+			log.WithFields(fields).WithField("error", err).
+				Warn("Check Failed HTTP Connect")
+			c.sleepRetry(ctx, i+2)
+			continue
+		}
+		return c.judgeHTTPResponse(resp, re, fields)
+	}
+	return false
+}
+
+// Judges a response against the check. The body is always closed
+// here since an unclosed body pins its connection, and checks run
+// often enough for that to exhaust sockets
+func (c *vpsHealthCheck) judgeHTTPResponse(resp *http.Response, re *regexp.Regexp, fields logrus.Fields) bool {
+	defer resp.Body.Close()
+
+	// A proxy or ALPN mismatch can silently fall back to HTTP/1.1
+	if c.ForceHTTP2 && resp.ProtoMajor != 2 {
+		log.WithFields(fields).WithField("proto", resp.Proto).
+			Warn("Check Failed HTTP/2 not negotiated")
+		return false
+	}
+	// Check response code
+	if !c.expectedCode(resp.StatusCode) {
+		log.WithFields(fields).WithFields(logrus.Fields{
+			"responseWanted":   c.ResponseCode,
+			"responseCodes":    c.ResponseCodes,
+			"responseRecieved": resp.StatusCode,
+		}).Warn("Check Failed HTTP Response Code")
+		return false
+	}
+	// Check body against regex and JSON, HEAD has no body.
+	// Only the first maxBodyBytes are read so a huge or slow
+	// body can't stall the check
+	if (c.MatchRegEx == "" && len(c.ExpectJSON) == 0) || c.Method == http.MethodHead {
+		return true
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, int64(c.MaxBodyBytes)))
+	if c.MatchRegEx != "" && !re.Match(body) {
+		log.WithFields(fields).WithFields(logrus.Fields{
+			"wantedRegEx":  c.MatchRegEx,
+			"maxBodyBytes": c.MaxBodyBytes,
+		}).Warn("Check Failed HTTP Body Match")
+		log.Tracef("Response Body: %s", body)
+		return false
+	}
+	if len(c.ExpectJSON) > 0 {
+		if err := matchJSON(body, c.ExpectJSON); err != nil {
+			log.WithFields(fields).WithFields(logrus.Fields{
+				"expectJSON":   c.ExpectJSON,
+				"maxBodyBytes": c.MaxBodyBytes,
+				"error":        err,
+			}).Warn("Check Failed HTTP JSON Match")
+			log.Tracef("Response Body: %s", body)
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the transport for a run of the check. By default each run
+// builds its own, so connections are reused only across retries,
+// or not at all with DisableKeepAlive. ReuseConnections keeps one
+// transport for the life of the check, so frequent probes skip the
+// handshake but may ride a connection opened over an older path
+func (c *vpsHealthCheck) httpTransport() (*http.Transport, error) {
+	if c.conns != nil {
+		c.conns.mu.Lock()
+		defer c.conns.mu.Unlock()
+		if c.conns.transport != nil {
+			return c.conns.transport, nil
+		}
+	}
+	tlsConfig, err := c.clientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: c.tmout,
+		DialContext:         c.dialer().DialContext,
+		ForceAttemptHTTP2:   c.ForceHTTP2,
+		DisableKeepAlives:   c.DisableKeepAlive,
+	}
+	if c.conns != nil {
+		// Dial with the current source address, which can change
+		// while the transport lives, and let pooled connections
+		// of replaced checks expire after a reload
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return c.dialer().DialContext(ctx, network, addr)
+		}
+		transport.IdleConnTimeout = reusedIdleTimeout
+		c.conns.transport = transport
+	}
+	return transport, nil
+}
+
+// Returns a dialer for the check, bound to the
+// interface address when bindToInterface is set
+func (c *vpsHealthCheck) dialer() *net.Dialer {
+	d := &net.Dialer{Timeout: c.tmout, Resolver: c.resolver()}
+	if c.srcIP != nil || c.SourcePort != 0 {
+		d.LocalAddr = &net.TCPAddr{IP: c.srcIP, Port: c.SourcePort}
+	}
+	if c.SocketMark != 0 || c.SourcePort != 0 {
+		d.Control = c.controlSocket
+	}
+	return d
+}
+
+// Resolves Host through Resolver when set, so a broken system DNS
+// path can't stall checks. Queries follow the check's source
+// address and socket mark like the check itself
+func (c *vpsHealthCheck) resolver() *net.Resolver {
+	if c.Resolver == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := &net.Dialer{Timeout: c.tmout}
+			if c.SocketMark != 0 {
+				d.Control = c.controlSocket
 			}
-			// Check body against regex
-			if c.MatchRegEx != "" {
-				defer resp.Body.Close()
-				body, _ := io.ReadAll(resp.Body)
-				if !re.Match(body) {
-					log.WithFields(fields).WithField("wantedRegEx", c.MatchRegEx).
-						Warn("Check Failed HTTP Body Match")
-					log.Tracef("Response Body: %s", body)
-					return false
+			if c.srcIP != nil {
+				if strings.HasPrefix(network, "udp") {
+					d.LocalAddr = &net.UDPAddr{IP: c.srcIP}
+				} else {
+					d.LocalAddr = &net.TCPAddr{IP: c.srcIP}
 				}
 			}
+			return d.DialContext(ctx, network, c.Resolver)
+		},
+	}
+}
+
+// Resolves Host for ICMP with resolver, preferring v4
+// unless ipv6 is set
+func (c *vpsHealthCheck) resolveIPAddr(ctx context.Context) (*net.IPAddr, error) {
+	if ip := net.ParseIP(c.Host); ip != nil {
+		return &net.IPAddr{IP: ip}, nil
+	}
+	addrs, err := c.resolver().LookupIPAddr(ctx, c.Host)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if (a.IP.To4() == nil) == c.IPv6 {
+			return &a, nil
+		}
+	}
+	if len(addrs) == 0 || c.IPv6 {
+		return nil, fmt.Errorf("no usable address for %s", c.Host)
+	}
+	return &addrs[0], nil
+}
+
+// Applies SO_MARK so probes can bypass the managed chain, and
+// SO_REUSEADDR so a fixed source port survives TIME_WAIT
+func (c *vpsHealthCheck) controlSocket(network, address string, conn syscall.RawConn) error {
+	var sockErr error
+	err := conn.Control(func(fd uintptr) {
+		if c.SocketMark != 0 {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(c.SocketMark))
+			if sockErr != nil {
+				return
+			}
+		}
+		if c.SourcePort != 0 {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// TLS client config honoring insecure, with an optional
+// client certificate for mTLS and CA bundle for verification
+func (c *vpsHealthCheck) clientTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.Insecure,
+	}
+	if c.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// True if code is within any of the expected response codes
+func (c *vpsHealthCheck) expectedCode(code int) bool {
+	for _, r := range c.responseCodes {
+		if code >= r.min && code <= r.max {
 			return true
 		}
-	default:
-		log.Warnf("Unimplemented method %s, check failed", c.Method)
-		return false
+	}
+	return false
+}
+
+// Builds the request for an HTTP health check
+// Body is only sent for POST and PUT
+func (c *vpsHealthCheck) newHTTPRequest(ctx context.Context, uri string) (*http.Request, error) {
+	var body io.Reader
+	if c.Body != "" && (c.Method == http.MethodPost || c.Method == http.MethodPut) {
+		body = strings.NewReader(c.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, c.Method, uri, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply headers, Go ignores Host in the header map
+	for k, v := range c.Headers {
+		if http.CanonicalHeaderKey(k) == "Host" {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	// Authentication
+	if c.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	} else if c.BasicAuthUser != "" {
+		req.SetBasicAuth(c.BasicAuthUser, c.BasicAuthPass)
+	}
+
+	// Trace final headers without credentials
+	headers := req.Header.Clone()
+	if headers.Get("Authorization") != "" {
+		headers.Set("Authorization", redacted)
+	}
+	log.WithFields(logrus.Fields{
+		"check":   c.Name,
+		"host":    req.Host,
+		"headers": headers,
+	}).Trace("HTTP Request Headers")
+
+	return req, nil
+}
+
+// Returns a copy of the check safe for logging
+func (c *vpsHealthCheck) redacted() vpsHealthCheck {
+	r := *c
+	if r.BasicAuthPass != "" {
+		r.BasicAuthPass = redacted
+	}
+	if r.BearerToken != "" {
+		r.BearerToken = redacted
+	}
+	// Headers carry API keys, only Host is shown
+	if len(r.Headers) > 0 {
+		r.Headers = make(map[string]string, len(c.Headers))
+		for k, v := range c.Headers {
+			if http.CanonicalHeaderKey(k) != "Host" {
+				v = redacted
+			}
+			r.Headers[k] = v
+		}
+	}
+	return r
+}
+
+// Performs a TLS certificate check against Host:Port
+// Fails if the leaf certificate is expired or expires within
+// minCertDaysLeft. Verifies the chain and hostname unless insecure.
+func (c *vpsHealthCheck) checkTLS(ctx context.Context) bool {
+	target := net.JoinHostPort(c.Host, c.Port)
+	tlsConfig := &tls.Config{
+		ServerName:         c.Host,
+		InsecureSkipVerify: c.Insecure,
+	}
+	for i := -1; i < c.Retries && ctx.Err() == nil; i++ {
+		dialer := &tls.Dialer{NetDialer: c.dialer(), Config: tlsConfig}
+		conn, err := dialer.DialContext(ctx, "tcp", target)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"check":  c.Name,
+				"target": target,
+				"error":  err,
+			}).Warnf("Check Failed TLS Handshake attempt %d", i+2)
+			c.sleepRetry(ctx, i+2)
+			continue
+		}
+		certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+		conn.Close()
+		if len(certs) == 0 {
+			log.WithFields(logrus.Fields{
+				"check":  c.Name,
+				"target": target,
+			}).Warn("Check failed, no certificate")
+			return false
+		}
+
+		// Check leaf expiry
+		leaf := certs[0]
+		left := time.Until(leaf.NotAfter)
+		if left <= 0 || left < time.Duration(c.MinCertDaysLeft)*24*time.Hour {
+			log.WithFields(logrus.Fields{
+				"check":           c.Name,
+				"target":          target,
+				"subject":         leaf.Subject.String(),
+				"notAfter":        leaf.NotAfter,
+				"daysLeft":        int(left.Hours() / 24),
+				"minCertDaysLeft": c.MinCertDaysLeft,
+			}).Warn("Check Failed TLS Certificate Expiry")
+			return false
+		}
+		log.Debugf("Check %s certificate valid until %s", c.Name, leaf.NotAfter)
+		return true
 	}
 	return false
 }
 
 // Performans an ICMP health check
-// Supports interval, timeout, count, maxrtt and maxlosspcnt
+// Supports interval, timeout, count, retries, maxrtt and maxlosspcnt
 //
 // If maxrtt or maxlosspcnt are specified, high rtt or icmp failures
 // can result in a failure. Otherwise only 100% failure.
-func (c *vpsHealthCheck) checkICMP() bool {
+//
+// Failed runs are retried like TCP/HTTP, passing if any run passes
+func (c *vpsHealthCheck) checkICMP(ctx context.Context) bool {
 	// Set Defaults
 	if c.Count == 0 {
 		c.Count = defICMPPings
@@ -239,19 +871,79 @@ func (c *vpsHealthCheck) checkICMP() bool {
 		"timeout":  c.Timeout,
 	}
 
-	// Prepare Pinger
-	p, err := ping.NewPinger(c.Host)
+	for i := -1; i < c.Retries && ctx.Err() == nil; i++ {
+		fields["attempt"] = i + 2
+		if c.pingOnce(ctx, fields) {
+			return true
+		}
+		if i+1 < c.Retries {
+			c.sleepRetry(ctx, i+2)
+		}
+	}
+	return false
+}
+
+// Compares an RTT sample to the EWMA of earlier ones, failing when it
+// exceeds the baseline by MaxRTTDeviation. The first sample seeds the
+// baseline and failing samples are left out, so a brownout can't
+// become the new normal
+func (c *vpsHealthCheck) checkRTTBaseline(rtt time.Duration, fields map[string]any) bool {
+	if c.MaxRTTDeviation == 0 {
+		return true
+	}
+	if c.rttEWMA == 0 {
+		c.rttEWMA = rtt
+		log.WithFields(fields).WithField("baselineRTT", c.rttEWMA).Trace("Seeded ICMP RTT baseline")
+		return true
+	}
+	if limit := time.Duration(float64(c.rttEWMA) * c.MaxRTTDeviation); rtt > limit {
+		log.WithFields(fields).WithFields(logrus.Fields{
+			"avgRTT":          rtt,
+			"baselineRTT":     c.rttEWMA,
+			"maxRTTDeviation": c.MaxRTTDeviation,
+		}).Warn("Check Failed ICMP RTT Deviation")
+		return false
+	}
+	c.rttEWMA += time.Duration(rttEWMAWeight * float64(rtt-c.rttEWMA))
+	log.WithFields(fields).WithField("baselineRTT", c.rttEWMA).Trace("Updated ICMP RTT baseline")
+	return true
+}
+
+// Runs a single pinger and evaluates its statistics
+func (c *vpsHealthCheck) pingOnce(ctx context.Context, fields map[string]any) bool {
+	p, err := c.newPinger(ctx, fields)
 	if err != nil {
 		log.Errorf("Failed to Prepare Pinger: %+v", err)
 		return false
 	}
-	p.Count = c.Count
-	p.Interval = c.reqInterval
-	p.Timeout = c.tmout
-	log.Tracef("Pinger Configured: %+v", p)
 
-	// Run
-	err = p.Run()
+	// Throwaway pings so tunnel setup and ARP don't inflate the RTT
+	if c.WarmupPings > 0 {
+		if w, err := c.newPinger(ctx, fields); err == nil {
+			w.Count = c.WarmupPings
+			err = runPinger(ctx, w)
+			log.WithFields(fields).WithFields(logrus.Fields{
+				"warmupPings": c.WarmupPings,
+				"stats":       w.Statistics(),
+				"error":       err,
+			}).Trace("ICMP warmup complete")
+		}
+	}
+
+	// go-ping only matches the timestamp and tracker at the front of
+	// the payload, so with packetSize set count replies that come back
+	// shorter than sent, cut by a middlebox or fragment handling
+	var short int
+	if c.PacketSize > 0 {
+		sent := p.Size + 8 // ICMP echo header
+		p.OnRecv = func(pkt *ping.Packet) {
+			if pkt.Nbytes < sent {
+				short++
+			}
+		}
+	}
+
+	err = runPinger(ctx, p)
 	if err != nil {
 		log.WithFields(fields).WithField("error", err).Error("ICMP Check Failed")
 		return false
@@ -260,12 +952,24 @@ func (c *vpsHealthCheck) checkICMP() bool {
 	// Check Results
 	// MaxRTT and Packet Loss Toleration Optional
 	stats := p.Statistics()
-	log.Tracef("ICMP Stats for %s: %+v", c.Name, stats)
+	c.latency = stats.AvgRtt
+	log.Tracef("ICMP Stats for %s (%d byte payload): %+v", c.Name, p.Size, stats)
+
+	// Check echoes came back whole
+	if short > 0 {
+		log.WithFields(fields).WithField("shortReplies", short).Warn("Check Failed ICMP Echo Truncated")
+		return false
+	}
 
 	// Check Average RTT
-	if c.MaxRTT != 0 && stats.AvgRtt > time.Duration(c.MaxRTT*int(time.Millisecond)) {
+	if c.maxRTT != 0 && stats.AvgRtt > c.maxRTT {
 		log.WithFields(fields).WithField("avgRTT", stats.AvgRtt).
-			WithField("wantedRTT", c.MaxRTT).Warn("Check Failed ICMP RTT")
+			WithField("wantedRTT", c.maxRTT).Warn("Check Failed ICMP RTT")
+		return false
+	}
+
+	// Check Average RTT against its own baseline
+	if stats.PacketsRecv > 0 && !c.checkRTTBaseline(stats.AvgRtt, fields) {
 		return false
 	}
 
@@ -286,34 +990,196 @@ func (c *vpsHealthCheck) checkICMP() bool {
 	return true
 }
 
+// Prepares a pinger for Host, resolving v6 only if asked
+func (c *vpsHealthCheck) newPinger(ctx context.Context, fields map[string]any) (*ping.Pinger, error) {
+	p := ping.New(c.Host)
+	if c.IPv6 {
+		p.SetNetwork("ip6")
+	}
+	var err error
+	if c.Resolver != "" {
+		var ipAddr *net.IPAddr
+		if ipAddr, err = c.resolveIPAddr(ctx); err == nil {
+			p.SetIPAddr(ipAddr)
+		}
+	} else {
+		err = p.Resolve()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// ICMPv6 echo needs the v6 network and a raw socket, v4 uses
+	// unprivileged sockets where the kernel allows them. Either
+	// can be forced with icmpPrivileged
+	privileged := !unprivilegedPingAllowed()
+	if p.IPAddr().IP.To4() == nil {
+		p.SetNetwork("ip6")
+		privileged = true
+		fields["ipv6"] = true
+	}
+	if c.ICMPPrivileged != nil {
+		privileged = *c.ICMPPrivileged
+	}
+	p.SetPrivileged(privileged)
+	fields["privileged"] = privileged
+	log.WithFields(fields).Debug("Pinger socket mode selected")
+	p.Count = c.Count
+	p.Interval = c.reqInterval
+	if c.PacketSize > 0 {
+		p.Size = c.PacketSize
+	}
+	fields["size"] = p.Size
+	p.Timeout = c.tmout
+	if c.srcIP != nil {
+		p.Source = c.srcIP.String()
+	}
+	log.Tracef("Pinger Configured: %+v", p)
+	return p, nil
+}
+
+// Runs a pinger, stopping early at the deadline
+func runPinger(ctx context.Context, p *ping.Pinger) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Stop()
+		case <-done:
+		}
+	}()
+	return p.Run()
+}
+
 // Perform a TCP health check, supports a timeout
 // as well as retries and interval between checks
 //
-// Does not send or receive any data
-func (c *vpsHealthCheck) checkTCP() bool {
+// Optionally sends sendData and matches the response against
+// expectRegEx, otherwise only connects
+func (c *vpsHealthCheck) checkTCP(ctx context.Context) bool {
+	// Compiled at config load, nil without ExpectRegEx
+	re := c.expectRe
+
 	// Attempt TCP Connect
 	target := net.JoinHostPort(c.Host, c.Port)
-	for i := -1; i < c.Retries; i++ {
-		conn, err := net.DialTimeout("tcp", target, c.tmout)
+	for i := -1; i < c.Retries && ctx.Err() == nil; i++ {
+		start := time.Now()
+		conn, err := c.dialer().DialContext(ctx, "tcp", target)
+		c.latency = time.Since(start)
 		// Failed
 		if err != nil {
-			log.Warnf("Check %s failed attempt %d", c.Name, i+2)
-			time.Sleep(c.reqInterval)
+			log.WithFields(logrus.Fields{
+				"check":   c.Name,
+				"attempt": i + 2,
+			}).Warn("Check failed attempt")
+			c.sleepRetry(ctx, i+2)
 			continue
 		}
-		// Succeeded
-		if conn != nil {
+		// Connect only
+		if c.SendData == "" && re == nil {
 			conn.Close()
 			return true
 		}
+		// Exchange data
+		err = c.exchangeTCP(ctx, conn, re)
+		c.latency = time.Since(start)
+		conn.Close()
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"check":       c.Name,
+				"target":      target,
+				"expectRegEx": c.ExpectRegEx,
+				"error":       err,
+			}).Warnf("Check Failed TCP Exchange attempt %d", i+2)
+			c.sleepRetry(ctx, i+2)
+			continue
+		}
+		return true
 	}
 	return false
 }
 
+// Writes sendData and reads until the response matches re,
+// the connection is deadlined at tmout for both
+func (c *vpsHealthCheck) exchangeTCP(ctx context.Context, conn net.Conn, re *regexp.Regexp) error {
+	if err := conn.SetDeadline(ioDeadline(ctx, c.tmout)); err != nil {
+		return err
+	}
+	if c.SendData != "" {
+		if _, err := conn.Write([]byte(c.SendData)); err != nil {
+			return err
+		}
+	}
+	if re == nil {
+		return nil
+	}
+
+	// Responses may arrive in pieces
+	var resp []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		resp = append(resp, buf[:n]...)
+		if re.Match(resp) {
+			return nil
+		}
+		if err != nil {
+			log.Tracef("TCP Response for %s: %q", c.Name, resp)
+			return fmt.Errorf("response did not match: %w", err)
+		}
+		if len(resp) >= maxTCPResponse {
+			log.Tracef("TCP Response for %s: %q", c.Name, resp)
+			return fmt.Errorf("response did not match within %d bytes", maxTCPResponse)
+		}
+	}
+}
+
+var (
+	pingModeOnce sync.Once
+	pingUnprivOK bool
+)
+
+// Detects once whether unprivileged ICMP sockets are permitted,
+// which net.ipv4.ping_group_range must include our group for
+func unprivilegedPingAllowed() bool {
+	pingModeOnce.Do(func() {
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_ICMP)
+		if err == nil {
+			unix.Close(fd)
+			pingUnprivOK = true
+		}
+		log.WithFields(logrus.Fields{
+			"unprivileged": pingUnprivOK,
+			"error":        err,
+		}).Info("Detected ICMP socket mode, set icmpPrivileged to override")
+	})
+	return pingUnprivOK
+}
+
+// Waits d between retries, returning early once ctx ends
+func sleepCtx(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// Socket deadline for tmout, brought in to the ctx deadline
+func ioDeadline(ctx context.Context, tmout time.Duration) time.Time {
+	d := time.Now().Add(tmout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(d) {
+		return dl
+	}
+	return d
+}
+
 // Basic health checks for defined interface
 // Checks to ensure the interface exists, is up,
-// and has the expected address
-func (i *vpsInterface) basicChecks() {
+// has the expected address and MTU, and can reach its gateway
+func (i *vpsInterface) basicChecks(ctx context.Context) {
 	// Make sure the interface is present
 	var exists bool
 	exists, i.nif = getInterface(i.Name)
@@ -330,31 +1196,245 @@ func (i *vpsInterface) basicChecks() {
 		}
 
 		// Make sure it's configured as expected
-		if i.checkIPv4Address() {
-			log.Debugf("Interface %s has address %s", i.Name, i.Address)
+		if i.checkAddress() {
+			log.Debugf("Interface %s has address %s", i.Name, i.expectedAddresses())
 			i.status.addressed = true
 		}
+
+		// SLAAC addresses can't be expected exactly
+		if i.DynamicIPv6 {
+			i.checkIPv6Address()
+		}
+		if i.ExpectIPv6Router {
+			i.checkIPv6Router()
+		}
+
+		// Catch MTU changes that black hole large packets
+		if i.ExpectedMTU != 0 {
+			i.checkMTU()
+		}
+
+		// A withdrawn route black holes a healthy link
+		if i.expectRoute != nil {
+			i.checkRoute()
+		}
+
+		// Up and addressed but carrying nothing
+		if i.MinTrafficBytes > 0 {
+			i.checkTraffic()
+		}
+
+		// Fail fast on a broken local link
+		if i.gatewayProbe != nil && i.status.up && i.status.addressed {
+			i.checkGateway(ctx)
+		}
+	}
+}
+
+// Compares the interface MTU to ExpectedMTU, recorded as mtu_ok
+func (i *vpsInterface) checkMTU() {
+	if i.status.healthChecks == nil {
+		i.status.reset(len(i.Checks))
+	}
+	ok := i.nif.MTU == i.ExpectedMTU
+	if !ok {
+		log.WithFields(logrus.Fields{
+			"nif":         i.Name,
+			"mtu":         i.nif.MTU,
+			"expectedMTU": i.ExpectedMTU,
+		}).Warn("Check Failed Interface MTU")
+	}
+	i.status.setCheck("mtu_ok", ok, 0)
+}
+
+// Pings the configured gateway from the interface address,
+// recorded as gateway_reachable
+func (i *vpsInterface) checkGateway(ctx context.Context) {
+	if i.status.healthChecks == nil {
+		i.status.reset(len(i.Checks))
+	}
+	probe := i.gatewayProbe
+	probe.IPv6 = net.ParseIP(i.Gateway).To4() == nil
+	probe.srcIP = i.sourceIPFor(probe.IPv6)
+	probe.latency = 0
+	if probe.srcIP == nil {
+		log.WithFields(logrus.Fields{
+			"nif":     i.Name,
+			"gateway": i.Gateway,
+		}).Warn("Check Failed, no interface address of the gateway's family")
+		i.status.setCheck(probe.Name, false, 0)
+		return
+	}
+	reachable, _ := probe.limitedRun(ctx)
+	if !reachable {
+		log.WithFields(logrus.Fields{
+			"nif":     i.Name,
+			"gateway": i.Gateway,
+			"srcIP":   probe.srcIP,
+		}).Warn("Check Failed Gateway Unreachable")
 	}
+	i.status.setCheck(probe.Name, reachable, probe.latency)
 }
 
-// Checks to see if an interface has the IP Address
-// assigned, and matching what is expected
-func (i *vpsInterface) checkIPv4Address() bool {
+// Checks the interface has every expected address assigned
+// Addresses are compared as parsed prefixes, so v4 and v6
+// match regardless of how they're written. With matchAddressExact
+// off, an expected IP inside any assigned prefix matches. An
+// expected network, see addressRange, matches any IP inside it
+func (i *vpsInterface) checkAddress() bool {
 	addrs, err := i.nif.Addrs()
 	if err != nil {
 		log.Errorf("Failed to get interface %s addresses: %+v", i.Name, err)
 		return false
 	}
+	exact := i.MatchAddressExact == nil || *i.MatchAddressExact
+	var assigned []*net.IPNet
 	for _, a := range addrs {
 		log.WithFields(logrus.Fields{
 			"nif":  i.Name,
 			"addr": a,
 		}).Trace("Found IP Address")
-		if a.String() == i.Address {
-			return true
+		if ipNet, ok := a.(*net.IPNet); ok {
+			assigned = append(assigned, ipNet)
 		}
 	}
-	return false
+
+	for _, want := range i.expectedAddresses() {
+		ip, wantNet, err := net.ParseCIDR(want)
+		if err != nil {
+			log.Errorf("Bad address %s for interface %s: %+v", want, i.Name, err)
+			return false
+		}
+		wantOnes, _ := wantNet.Mask.Size()
+		_, isRange := addressRange(want)
+		found := false
+		for _, n := range assigned {
+			ones, _ := n.Mask.Size()
+			if isRange && wantNet.Contains(n.IP) {
+				found = true
+				break
+			}
+			if exact && n.IP.Equal(ip) && ones == wantOnes {
+				found = true
+				break
+			}
+			if !exact && n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.WithFields(logrus.Fields{
+				"nif":      i.Name,
+				"expected": want,
+				"observed": addrs,
+				"exact":    exact,
+			}).Warn("Interface missing expected address")
+			return false
+		}
+	}
+	return true
+}
+
+// Address followed by Addresses, empty entries skipped
+func (i *vpsInterface) expectedAddresses() []string {
+	var addrs []string
+	if i.Address != "" {
+		addrs = append(addrs, i.Address)
+	}
+	for _, a := range i.Addresses {
+		if a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// Returns the prefix when an expected address is written as a
+// network, e.g. 10.8.0.0/24, meaning any address within it. Host
+// routes and addresses with host bits set are exact
+func addressRange(addr string) (*net.IPNet, bool) {
+	ip, n, err := net.ParseCIDR(addr)
+	if err != nil {
+		return nil, false
+	}
+	ones, bits := n.Mask.Size()
+	return n, ones < bits && ip.Equal(n.IP)
+}
+
+// Returns the interface IP to bind checks to, preferring the
+// configured address and falling back to the first one assigned
+func (i *vpsInterface) sourceIP() net.IP {
+	if ips := i.sourceIPs(); len(ips) > 0 {
+		return ips[0]
+	}
+	return nil
+}
+
+// First address checks may bind to of the family, IPv6 or IPv4
+func (i *vpsInterface) sourceIPFor(v6 bool) net.IP {
+	for _, ip := range i.sourceIPs() {
+		if (ip.To4() == nil) == v6 {
+			return ip
+		}
+	}
+	return nil
+}
+
+// Every address checks may bind to, the expected addresses if
+// configured, otherwise those on the interface. A range stands
+// for the address assigned within it
+func (i *vpsInterface) sourceIPs() []net.IP {
+	var ips []net.IP
+	for _, a := range i.expectedAddresses() {
+		if n, isRange := addressRange(a); isRange {
+			if ip := i.assignedIn(n); ip != nil {
+				ips = append(ips, ip)
+			}
+		} else if ip, _, err := net.ParseCIDR(a); err == nil {
+			ips = append(ips, ip)
+		} else if ip := net.ParseIP(a); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) > 0 || i.nif == nil {
+		return ips
+	}
+	addrs, err := i.nif.Addrs()
+	if err != nil {
+		log.Errorf("Failed to get interface %s addresses: %+v", i.Name, err)
+		return nil
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		// Link-local can't be bound without a zone, use the SLAAC address
+		if i.DynamicIPv6 && ipNet.IP.To4() == nil && !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+	return ips
+}
+
+// First address assigned to the interface within n, nil if none
+func (i *vpsInterface) assignedIn(n *net.IPNet) net.IP {
+	if i.nif == nil {
+		return nil
+	}
+	addrs, err := i.nif.Addrs()
+	if err != nil {
+		log.Errorf("Failed to get interface %s addresses: %+v", i.Name, err)
+		return nil
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && n.Contains(ipNet.IP) {
+			return ipNet.IP
+		}
+	}
+	return nil
 }
 
 // Checks to see if provided interface is up
@@ -363,7 +1443,7 @@ func (i *vpsInterface) checkInterfaceUp() bool {
 	if i.nif.Flags&net.FlagUp != 0 {
 		return true
 	}
-	log.Warnf("Interface %s is not up!", i.Name)
+	log.WithField("nif", i.Name).Warn("Interface is not up!")
 	return false
 }
 
@@ -380,16 +1460,57 @@ func getInterface(name string) (bool, *net.Interface) {
 // Resets stats for all interfaces
 func resetHealth() {
 	for _, i := range config.Interfaces {
-		i.status = new(interfaceStatus)
+		i.status = newInterfaceStatus(i)
+	}
+}
+
+// Empty status carrying the interface's quorum settings
+func newInterfaceStatus(i *vpsInterface) *interfaceStatus {
+	s := &interfaceStatus{
+		minHealthyChecks: i.MinHealthyChecks,
+		minHealthyWeight: i.MinHealthyWeight,
+	}
+	if i.MinHealthyChecks > 0 || i.MinHealthyWeight > 0 {
+		s.quorum = make(map[string]int, len(i.Checks))
+		for _, c := range i.Checks {
+			s.quorum[c.Name] = c.Weight
+		}
 	}
+	return s
 }
 
 // Resets health status for given interface
 func (s *interfaceStatus) reset(numChecks int) {
 	s.healthChecks = make(map[string]bool, numChecks)
+	s.latency = make(map[string]time.Duration, numChecks)
+	s.details = make(map[string]bool)
+}
+
+// Records a health check result, safe for concurrent checks
+// Latency is only kept when measured
+func (s *interfaceStatus) setCheck(name string, success bool, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.healthChecks[name] = success
+	if latency != 0 {
+		s.latency[name] = latency
+	}
 }
 
-// Checks all interfaces for health
+// Records a per address result of a checkAllAddresses check,
+// informational only as the check's own result decides health
+func (s *interfaceStatus) setDetail(name string, success bool, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.details[name] = success
+	if latency != 0 {
+		s.latency[name] = latency
+	}
+}
+
+// Checks all interfaces for health. Basic and wireguard checks
+// are mandatory, configured checks are too unless a quorum of
+// minHealthyChecks or minHealthyWeight is set
 func (s *interfaceStatus) healthy() (bool, []string) {
 	healthy := true
 	var reasons []string
@@ -403,11 +1524,44 @@ func (s *interfaceStatus) healthy() (bool, []string) {
 		healthy = false
 		reasons = append(reasons, "Interface not properly addressed")
 	}
+	passing, passingWeight, totalWeight := 0, 0, 0
+	var failedQuorum []string
 	for c, v := range s.healthChecks {
+		if weight, ok := s.quorum[c]; ok {
+			totalWeight += weight
+			if v {
+				passing++
+				passingWeight += weight
+			} else {
+				failedQuorum = append(failedQuorum, c)
+			}
+			continue
+		}
 		if !v {
 			healthy = false
 			reasons = append(reasons, fmt.Sprintf("Failed %s", c))
 		}
 	}
+
+	// Configured checks only need a quorum, when one is set
+	if s.quorum != nil && passing+len(failedQuorum) > 0 {
+		short := false
+		if passing < s.minHealthyChecks {
+			short = true
+			reasons = append(reasons, fmt.Sprintf("%d of %d checks passed, %d required",
+				passing, len(s.quorum), s.minHealthyChecks))
+		}
+		if passingWeight < s.minHealthyWeight {
+			short = true
+			reasons = append(reasons, fmt.Sprintf("weight %d of %d passed, %d required",
+				passingWeight, totalWeight, s.minHealthyWeight))
+		}
+		if short {
+			healthy = false
+			for _, c := range failedQuorum {
+				reasons = append(reasons, fmt.Sprintf("Failed %s", c))
+			}
+		}
+	}
 	return healthy, reasons
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Counts connections a test server has seen opened and closed
+type connTracker struct {
+	mu             sync.Mutex
+	opened, closed int
+}
+
+func (t *connTracker) track(_ net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		t.opened++
+	case http.StateClosed, http.StateHijacked:
+		t.closed++
+	}
+}
+
+// Waits for every opened connection to close, a connection whose
+// response body was never closed is never returned to the pool to
+// be dropped, so stays open
+func (t *connTracker) waitClosed(timeout time.Duration) (opened, closed int) {
+	deadline := time.Now().Add(timeout)
+	for {
+		t.mu.Lock()
+		opened, closed = t.opened, t.closed
+		t.mu.Unlock()
+		if (opened > 0 && opened == closed) || time.Now().After(deadline) {
+			return opened, closed
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCheckHTTPClosesBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		code   int
+		regex  string
+		want   bool
+	}{
+		{"matching code", http.MethodGet, 200, "", true},
+		{"non-matching code", http.MethodGet, 503, "", false},
+		{"matching body", http.MethodGet, 200, "^healthy", true},
+		{"non-matching body", http.MethodGet, 200, "^sick", false},
+		{"non-matching code with regex", http.MethodGet, 503, "^healthy", false},
+		{"head", http.MethodHead, 200, "^sick", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conns connTracker
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.code)
+				// Larger than a read buffer so an unread body can't
+				// be drained and reused behind the check's back
+				w.Write([]byte("healthy" + strings.Repeat(".", 64<<10)))
+			}))
+			srv.Config.ConnState = conns.track
+			srv.Start()
+			defer srv.Close()
+
+			codes, _ := parseResponseCodes(200, nil)
+			re, err := compileRegEx(tt.regex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &vpsHealthCheck{
+				Name:          tt.name,
+				Host:          strings.TrimPrefix(srv.URL, "http://"),
+				Path:          "/",
+				Method:        tt.method,
+				MatchRegEx:    tt.regex,
+				MaxBodyBytes:  1 << 10,
+				responseCodes: codes,
+				matchRe:       re,
+				// Outlasts the wait below, the client timeout
+				// would otherwise close a leaked body itself
+				tmout: time.Minute,
+			}
+			if got := c.checkHTTP(context.Background()); got != tt.want {
+				t.Errorf("checkHTTP() = %v, want %v", got, tt.want)
+			}
+			if opened, closed := conns.waitClosed(time.Second); opened != closed {
+				t.Errorf("%d of %d connections left open", opened-closed, opened)
+			}
+		})
+	}
+}
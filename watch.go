@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	configDebounce = 500 * time.Millisecond // Quiet time after a config write before reloading
+)
+
+// Running config watch, nil when watchConfig is off
+var configWatcher *fsnotify.Watcher
+
+// Watches configFile with fsnotify while watchConfig is set and
+// signals reload once writes settle. The parent directory is watched
+// since editors often write twice or replace the file outright.
+// Config directories are watched for any config file.
+//
+// Called again after every reload, a running watch is kept while
+// watchConfig stays set and stopped once it's turned off.
+//
+// Failure to watch is logged, SIGHUP still works.
+func watchConfig(reload chan<- struct{}) {
+	if !config.WatchConfig {
+		stopWatchingConfig()
+		return
+	}
+	if configWatcher != nil {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorf("Failed to watch config %s, reload with SIGHUP: %+v", configFile, err)
+		return
+	}
+
+	// Names of interest per directory, empty for any config file
+	watches := make(map[string]map[string]bool)
+	for _, path := range strings.Split(configFile, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		dir, name := filepath.Dir(path), filepath.Base(path)
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			dir, name = filepath.Clean(path), ""
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			log.Errorf("Failed to watch config %s, reload with SIGHUP: %+v", configFile, err)
+			return
+		}
+		if watches[dir] == nil {
+			watches[dir] = make(map[string]bool)
+		}
+		watches[dir][name] = true
+	}
+	log.Infof("Watching config %s for changes", configFile)
+
+	// True if the event is for one of our files
+	matches := func(path string) bool {
+		names := watches[filepath.Dir(path)]
+		if names[filepath.Base(path)] {
+			return true
+		}
+		return names[""] && contains(configExts, filepath.Ext(path))
+	}
+
+	configWatcher = watcher
+	go func() {
+		var debounce *time.Timer
+		defer func() {
+			if debounce != nil {
+				debounce.Stop()
+			}
+		}()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// Renames onto the file arrive as a create
+				if !(event.Has(fsnotify.Write) || event.Has(fsnotify.Create)) || !matches(event.Name) {
+					continue
+				}
+				log.Debugf("Config %s changed, %s", configFile, event)
+				if debounce == nil {
+					debounce = time.AfterFunc(configDebounce, func() {
+						select {
+						case reload <- struct{}{}:
+						default:
+						}
+					})
+				} else {
+					debounce.Reset(configDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("Error watching config %s: %+v", configFile, err)
+			}
+		}
+	}()
+}
+
+// Stops the running config watch, if any
+func stopWatchingConfig() {
+	if configWatcher == nil {
+		return
+	}
+	if err := configWatcher.Close(); err != nil {
+		log.Errorf("Failed to stop watching config %s: %+v", configFile, err)
+	}
+	configWatcher = nil
+	log.Infof("Stopped watching config %s", configFile)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfigDebouncesWrites(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	write := func() {
+		t.Helper()
+		if err := ioutil.WriteFile(file, []byte("interval: 1m\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write()
+	savedConfig, savedFile := config, configFile
+	t.Cleanup(func() {
+		stopWatchingConfig()
+		config, configFile = savedConfig, savedFile
+	})
+	config, configFile = &vpsInstance{WatchConfig: true}, file
+
+	reload := make(chan struct{}, 1)
+	watchConfig(reload)
+	if configWatcher == nil {
+		t.Fatal("config watch not established")
+	}
+
+	// Editors often write twice, one reload follows
+	write()
+	write()
+	select {
+	case <-reload:
+	case <-time.After(4 * configDebounce):
+		t.Fatal("no reload after config writes")
+	}
+	select {
+	case <-reload:
+		t.Error("config writes reloaded more than once")
+	case <-time.After(2 * configDebounce):
+	}
+
+	// A reload that turns watchConfig off stops the watch
+	config.WatchConfig = false
+	watchConfig(reload)
+	if configWatcher != nil {
+		t.Fatal("config watch still running with watchConfig off")
+	}
+	write()
+	select {
+	case <-reload:
+		t.Error("reloaded after the config watch stopped")
+	case <-time.After(2 * configDebounce):
+	}
+}
@@ -1,6 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -9,20 +17,25 @@ import (
 )
 
 var (
-	client  *wgctrl.Client
-	devices []*wgtypes.Device
+	client    wgClient
+	devices   []*wgtypes.Device
+	devicesMu sync.Mutex // Interfaces are checked concurrently
 )
 
+// The part of wgctrl.Client used, tests stand in a failing one
+type wgClient interface {
+	Devices() ([]*wgtypes.Device, error)
+}
+
 func wgInit() {
-	// Create Client
-	var err error
-	client, err = wgctrl.New()
-	if err != nil {
-		log.Fatalf("Unable to create wireguard client: %+v", err)
+	// Debug Devices, failures are retried by each check
+	// so a wireguard hiccup can't stop monitoring
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	if err := getWgDevs(); err != nil {
+		log.Errorf("Failed to retrieve wireguard devices: %+v", err)
+		return
 	}
-
-	// Debug Devices
-	getWgDevs()
 	printWgDevs(devices)
 
 	// Check if our declared wg devices exist
@@ -38,11 +51,20 @@ func wgInit() {
 
 // Health Checks for Wireguard Interface
 // Updates i.status.healthChecks[]
-func checkWgHealth(i *vpsInterface) {
-	// Refresh Devices
-	getWgDevs()
-	// Retrieve the device
+func checkWgHealth(ctx context.Context, i *vpsInterface) {
+	// Refresh Devices and retrieve ours
+	devicesMu.Lock()
+	err := getWgDevs()
 	device := getWgDev(i.Name)
+	devicesMu.Unlock()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"nif":   i.Name,
+			"error": err,
+		}).Warn("Check Failed Wireguard Device List")
+		i.status.healthChecks["wg_devices"] = false
+		return
+	}
 	if device == nil {
 		i.status.healthChecks["wg_dev_exists"] = false
 		return
@@ -50,17 +72,33 @@ func checkWgHealth(i *vpsInterface) {
 		i.status.healthChecks["wg_dev_exists"] = true
 	}
 
+	// Check our own listen port from outside
+	if i.wgReflectorProbe != nil {
+		i.checkWgInbound(ctx, device)
+	}
+
 	// Check for peer
 	if i.WGPeer != "" {
 		peer := getWgPeer(device, i.WGPeer)
 		if peer == nil {
-			log.Warnf("Check Failed Wireguard Peer %s %s", i.Name, i.WGPeer)
+			log.WithFields(logrus.Fields{
+				"nif":  i.Name,
+				"peer": i.WGPeer,
+			}).Warn("Check Failed Wireguard Peer")
 			i.status.healthChecks["wg_has_peer"] = false
 		} else {
 			log.Debugf("Found peer %s for interface %s", peer.PublicKey.PublicKey(), i.Name)
 			i.status.healthChecks["wg_has_peer"] = true
-			// Now check last peer handshake
+			// Now check last peer handshake, telling a gone
+			// peer apart from a broken path if it failed
 			i.checkWgLastHandshake(peer)
+			if !i.status.healthChecks["wg_last_handshake"] && i.wgEndpointProbe != nil {
+				i.checkWgEndpoint(ctx, peer)
+			}
+			// And that data is actually arriving
+			if i.wgMaxRxIdle > 0 {
+				i.checkWgRxIdle(peer)
+			}
 		}
 	}
 }
@@ -85,6 +123,123 @@ func (i *vpsInterface) checkWgLastHandshake(peer *wgtypes.Peer) {
 	}
 }
 
+// Checks the peer receive counter has grown within
+// vpsInterface.WGMaxRxIdle, catching a path that still
+// handshakes but blackholes data. Counters are kept
+// across ticks on the interface.
+func (i *vpsInterface) checkWgRxIdle(peer *wgtypes.Peer) {
+	now := time.Now()
+	if i.wgRxChanged.IsZero() || peer.ReceiveBytes != i.wgRxBytes {
+		i.wgRxBytes = peer.ReceiveBytes
+		i.wgRxChanged = now
+	}
+	idle := now.Sub(i.wgRxChanged)
+	if !peer.LastHandshakeTime.IsZero() && idle > i.wgMaxRxIdle {
+		log.WithFields(logrus.Fields{
+			"nif":          i.Name,
+			"peer":         peer.PublicKey.String(),
+			"receiveBytes": peer.ReceiveBytes,
+			"idle":         idle,
+			"maxRxIdle":    i.wgMaxRxIdle,
+		}).Warn("Check Failed Wireguard Peer Receive Idle")
+		i.status.healthChecks["wg_rx_idle"] = false
+	} else {
+		log.Debugf("Wireguard peer %s receive OK, idle %s", peer.PublicKey.String(), idle)
+		i.status.healthChecks["wg_rx_idle"] = true
+	}
+}
+
+// Probes the peer endpoint with vpsInterface.WGEndpointCheck
+// Unreachable suggests the peer moved or is gone, reachable
+// suggests the tunnel itself is broken
+func (i *vpsInterface) checkWgEndpoint(ctx context.Context, peer *wgtypes.Peer) {
+	if peer.Endpoint == nil {
+		log.WithFields(logrus.Fields{
+			"nif":  i.Name,
+			"peer": peer.PublicKey.String(),
+		}).Warn("Wireguard peer has no endpoint to probe")
+		i.status.healthChecks["wg_endpoint_reachable"] = false
+		return
+	}
+
+	probe := i.wgEndpointProbe
+	probe.Host = peer.Endpoint.IP.String()
+	var reachable bool
+	switch probe.Type {
+	case "icmp", "tcp":
+		reachable, _ = probe.limitedRun(ctx)
+	case "udp":
+		if release, ok := acquireProbe(ctx, probe.Name); ok {
+			reachable = probeWgEndpoint(ctx, peer.Endpoint, probe.tmout)
+			release()
+		}
+	}
+
+	fields := logrus.Fields{
+		"nif":      i.Name,
+		"peer":     peer.PublicKey.String(),
+		"endpoint": peer.Endpoint.String(),
+		"probe":    probe.Type,
+	}
+	if reachable {
+		log.WithFields(fields).Warn("Wireguard peer endpoint reachable, path likely broken")
+	} else {
+		log.WithFields(fields).Warn("Check Failed Wireguard Peer Endpoint Unreachable")
+	}
+	i.status.healthChecks["wg_endpoint_reachable"] = reachable
+}
+
+// Asks the wgReflector service whether our listen port is reachable
+// from outside, recorded as wg_inbound_reachable. The kernel owns
+// the port, so the watcher can't see inbound packets and leaves the
+// testing to the reflector: {port} in its URL is replaced with the
+// device listen port, and a 2xx answer means reachable
+func (i *vpsInterface) checkWgInbound(ctx context.Context, device *wgtypes.Device) {
+	fields := logrus.Fields{
+		"nif":        i.Name,
+		"listenPort": device.ListenPort,
+	}
+	probe := *i.wgReflectorProbe
+	u, err := url.Parse(strings.ReplaceAll(i.WGReflector, "{port}", strconv.Itoa(device.ListenPort)))
+	if err != nil || device.ListenPort == 0 {
+		log.WithFields(fields).WithField("error", err).
+			Warn("Check Failed Wireguard Inbound, no reflector URL or listen port")
+		i.status.healthChecks[probe.Name] = false
+		return
+	}
+	probe.TLS = u.Scheme == "https"
+	probe.Host = u.Host
+	probe.Path = u.RequestURI()
+
+	reachable, _ := probe.limitedRun(ctx)
+	if reachable {
+		log.WithFields(fields).Debug("Wireguard listen port reachable from outside")
+	} else {
+		log.WithFields(fields).Warn("Check Failed Wireguard Inbound Unreachable")
+	}
+	i.status.healthChecks[probe.Name] = reachable
+}
+
+// Sends a datagram to a wireguard endpoint. Wireguard never
+// answers unauthenticated packets, so only an explicit rejection
+// (ICMP port unreachable) reads as unreachable.
+func probeWgEndpoint(ctx context.Context, addr *net.UDPAddr, timeout time.Duration) bool {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(ioDeadline(ctx, timeout))
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return false
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		var ne net.Error
+		return errors.As(err, &ne) && ne.Timeout()
+	}
+	return true
+}
+
 // Retrieves a wireguard peer by name
 func getWgPeer(device *wgtypes.Device, peerID string) *wgtypes.Peer {
 	var peer *wgtypes.Peer
@@ -111,13 +266,20 @@ func getWgDev(name string) *wgtypes.Device {
 	return device
 }
 
-// Fetches / refreshes wireguard devices
-func getWgDevs() {
+// Fetches / refreshes wireguard devices, creating the client
+// if it isn't open yet. On error devices is cleared
+func getWgDevs() error {
+	if client == nil {
+		c, err := wgctrl.New()
+		if err != nil {
+			devices = nil
+			return fmt.Errorf("unable to create wireguard client: %w", err)
+		}
+		client = c
+	}
 	var err error
 	devices, err = client.Devices()
-	if err != nil {
-		log.Fatalf("Failed to retrieve wireguard devices: %+v", err)
-	}
+	return err
 }
 
 // Trace prints wireguard devices
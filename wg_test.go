@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Lists devs, or fails with err
+type testWgClient struct {
+	devs []*wgtypes.Device
+	err  error
+}
+
+func (c *testWgClient) Devices() ([]*wgtypes.Device, error) {
+	return c.devs, c.err
+}
+
+func TestWgDevicesErrorNonFatal(t *testing.T) {
+	trapExit(t)
+	savedClient, savedDevices, savedConfig := client, devices, config
+	t.Cleanup(func() {
+		client, devices, config = savedClient, savedDevices, savedConfig
+	})
+
+	wc := &testWgClient{err: errors.New("netlink hiccup")}
+	client = wc
+	i := &vpsInterface{Name: "wg0", Wireguard: true}
+	config = &vpsInstance{Interfaces: []*vpsInterface{i}}
+
+	// Startup logs the failure and carries on
+	wgInit()
+
+	// The check fails the interface rather than the process
+	i.status = newInterfaceStatus(i)
+	i.status.reset(0)
+	checkWgHealth(context.Background(), i)
+	if ok, found := i.status.healthChecks["wg_devices"]; !found || ok {
+		t.Errorf("wg_devices = %v (found %v), want a failed check", ok, found)
+	}
+	if devices != nil {
+		t.Errorf("devices %v kept after a failed refresh", devices)
+	}
+
+	// And recovers once the client does
+	wc.devs, wc.err = []*wgtypes.Device{{Name: "wg0"}}, nil
+	i.status.reset(0)
+	checkWgHealth(context.Background(), i)
+	if !i.status.healthChecks["wg_dev_exists"] {
+		t.Errorf("wg0 not found after the client recovered, checks %v", i.status.healthChecks)
+	}
+	if _, found := i.status.healthChecks["wg_devices"]; found {
+		t.Error("wg_devices still failed after the client recovered")
+	}
+}